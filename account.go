@@ -0,0 +1,163 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+)
+
+// These error codes are returned by Ubuntu SSO in the Code field of an
+// *Error.
+const (
+	// CodeInvalidData is returned when one or more fields in a
+	// request are invalid, for example when a password is too weak.
+	// The problems with each field are available from
+	// Error.FieldErrors.
+	CodeInvalidData = "INVALID_DATA"
+
+	// CodeAlreadyRegistered is returned when registering an account
+	// with an email address that is already in use.
+	CodeAlreadyRegistered = "ALREADY_REGISTERED"
+
+	// CodeCaptchaRequired is returned when a request must include a
+	// solved captcha.
+	CodeCaptchaRequired = "CAPTCHA_REQUIRED"
+
+	// CodeCaptchaFailure is returned when the captcha solution is
+	// wrong.
+	CodeCaptchaFailure = "CAPTCHA_FAILURE"
+
+	// CodeInvalidCredentials is returned when the email and password,
+	// or the OAuth signature, of a request are not valid.
+	CodeInvalidCredentials = "INVALID_CREDENTIALS"
+
+	// CodeTwoFactorRequired is returned when a request must include a
+	// one-time password.
+	CodeTwoFactorRequired = "TWOFACTOR_REQUIRED"
+
+	// CodeTwoFactorFailure is returned when the one-time password is
+	// wrong.
+	CodeTwoFactorFailure = "TWOFACTOR_FAILURE"
+
+	// CodeAccountSuspended is returned when the account has been
+	// suspended.
+	CodeAccountSuspended = "ACCOUNT_SUSPENDED"
+
+	// CodeResourceNotFound is returned when the requested account or
+	// token does not exist.
+	CodeResourceNotFound = "RESOURCE_NOT_FOUND"
+
+	// CodeCanNotResetPassword is returned when the password of the
+	// account cannot be reset, for example because the account is
+	// suspended.
+	CodeCanNotResetPassword = "CAN_NOT_RESET_PASSWORD"
+
+	// CodeTooManyRequests is returned when the client has exceeded the
+	// server's rate limit. The error's RetryAfter field holds the time
+	// to wait before trying again, if the server gave one.
+	CodeTooManyRequests = "TOO_MANY_REQUESTS"
+)
+
+// FieldErrors returns the problems found with individual fields of the
+// request, keyed by field name. It returns nil unless the error has the
+// code CodeInvalidData.
+func (err *Error) FieldErrors() map[string][]string {
+	if err.Code != CodeInvalidData {
+		return nil
+	}
+	fields := make(map[string][]string)
+	for k, v := range err.Extra {
+		switch v := v.(type) {
+		case string:
+			fields[k] = append(fields[k], v)
+		case []interface{}:
+			for _, m := range v {
+				if m, ok := m.(string); ok {
+					fields[k] = append(fields[k], m)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// Account holds the details of an Ubuntu SSO account.
+type Account struct {
+	// OpenID holds the account's OpenID identifier.
+	OpenID string `json:"openid"`
+
+	// Href holds the path of the account in the API.
+	Href string `json:"href,omitempty"`
+
+	// Email holds the account's preferred email address.
+	Email string `json:"email"`
+
+	// DisplayName holds the user's name as displayed to others.
+	DisplayName string `json:"displayname"`
+
+	// Username holds the account's user name, if it has one.
+	Username string `json:"username,omitempty"`
+
+	// Status holds the status of the account, for example "Active".
+	Status string `json:"status,omitempty"`
+
+	// Verified reports whether the email address has been verified.
+	Verified bool `json:"verified"`
+
+	// Tokens holds the OAuth tokens issued to the account. It is only
+	// returned to requests signed by one of the account's tokens.
+	Tokens []TokenDetails `json:"tokens,omitempty"`
+}
+
+// registrationPath is the path where new accounts are registered.
+const registrationPath = "/api/v2/accounts"
+
+// RegisterAccount creates a new account with the given email address,
+// password and display name. If the server requires a captcha then the
+// identifier of the captcha and its solution should be provided,
+// otherwise they can be blank. If an error is returned from the identity
+// server then it will be of type *Error; an invalid email address or a
+// weak password is reported with the code CodeInvalidData and an email
+// address that is already in use with the code CodeAlreadyRegistered.
+func (server UbuntuSSOServer) RegisterAccount(ctx context.Context, email, password, displayName, captchaID, captchaSolution string) (*Account, error) {
+	data := map[string]string{
+		"email":       email,
+		"password":    password,
+		"displayname": displayName,
+	}
+	if captchaID != "" {
+		data["captcha_id"] = captchaID
+		data["captcha_solution"] = captchaSolution
+	}
+	var account Account
+	if err := server.do(ctx, nil, "POST", registrationPath, false, data, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// passwordResetPath is the path where password reset tokens are
+// requested.
+const passwordResetPath = "/api/v2/tokens/password"
+
+// RequestPasswordReset asks the server to email a password reset link
+// to the account with the given email address. If an error is returned
+// from the identity server then it will be of type *Error; an unknown
+// email address is reported with the code CodeResourceNotFound and a
+// rate limited request with the code CodeTooManyRequests. Each request
+// sends an email, so failed requests are never retried, even when the
+// server's RetryPolicy has RetryNonIdempotent set.
+func (server UbuntuSSOServer) RequestPasswordReset(ctx context.Context, email string) error {
+	data := map[string]string{
+		"email": email,
+	}
+	if server.RetryPolicy != nil {
+		// server is a copy, so this only affects this request. The
+		// policy is copied too so that its Hook is still called.
+		policy := *server.RetryPolicy
+		policy.MaxAttempts = 1
+		server.RetryPolicy = &policy
+	}
+	return server.do(ctx, nil, "POST", passwordResetPath, false, data, nil)
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var requestPasswordResetErrorTests = []struct {
+	about            string
+	status           int
+	header           http.Header
+	body             string
+	expectError      string
+	expectCode       string
+	expectRetryAfter time.Duration
+}{{
+	about:       "unknown email",
+	status:      http.StatusNotFound,
+	body:        `{"code": "RESOURCE_NOT_FOUND", "message": "No account associated with foo@bar.com"}`,
+	expectError: "No account associated with foo@bar.com",
+	expectCode:  CodeResourceNotFound,
+}, {
+	about:       "cannot reset",
+	status:      http.StatusForbidden,
+	body:        `{"code": "CAN_NOT_RESET_PASSWORD", "message": "Can not reset password. Please contact login support"}`,
+	expectError: "Can not reset password. Please contact login support",
+	expectCode:  CodeCanNotResetPassword,
+}, {
+	about:            "rate limited",
+	status:           http.StatusTooManyRequests,
+	header:           http.Header{"Retry-After": {"30"}},
+	body:             `{"code": "TOO_MANY_REQUESTS", "message": "Too many requests"}`,
+	expectError:      "Too many requests",
+	expectCode:       CodeTooManyRequests,
+	expectRetryAfter: 30 * time.Second,
+}, {
+	about:            "rate limited by proxy",
+	status:           http.StatusTooManyRequests,
+	header:           http.Header{"Retry-After": {"60"}},
+	body:             `<html>Too Many Requests</html>`,
+	expectError:      "<html>Too Many Requests</html>",
+	expectCode:       CodeTooManyRequests,
+	expectRetryAfter: time.Minute,
+}}
+
+func TestRequestPasswordResetErrors(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range requestPasswordResetErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			requests, attempts := 0, 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requests++
+				for k, v := range test.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+			server := UbuntuSSOServer{
+				baseUrl: srv.URL,
+				RetryPolicy: &RetryPolicy{
+					MaxAttempts:        4,
+					MinDelay:           time.Millisecond,
+					RetryNonIdempotent: true,
+					Hook: func(a *Attempt) {
+						attempts++
+						c.Check(a.Retry, qt.IsFalse)
+					},
+				},
+			}
+			err := server.RequestPasswordReset(context.Background(), email)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			ssoError := err.(*Error)
+			c.Assert(ssoError.Code, qt.Equals, test.expectCode)
+			c.Assert(ssoError.StatusCode, qt.Equals, test.status)
+			c.Assert(ssoError.RetryAfter, qt.Equals, test.expectRetryAfter)
+			c.Assert(requests, qt.Equals, 1)
+			c.Assert(attempts, qt.Equals, 1)
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OAuthEndpoints holds the URLs used in the three-legged OAuth flow,
+// see http://tools.ietf.org/html/rfc5849#section-2.
+type OAuthEndpoints struct {
+	// RequestTokenURL holds the URL where temporary credentials are
+	// requested.
+	RequestTokenURL string
+
+	// AuthorizeURL holds the URL the user visits to authorize the
+	// temporary credentials.
+	AuthorizeURL string
+
+	// AccessTokenURL holds the URL where authorized temporary
+	// credentials are exchanged for token credentials.
+	AccessTokenURL string
+}
+
+// RequestToken holds the temporary credentials issued at the start of
+// the three-legged OAuth flow.
+type RequestToken struct {
+	// Token holds the temporary credentials identifier.
+	Token string
+
+	// Secret holds the temporary credentials shared secret.
+	Secret string
+
+	// CallbackConfirmed records whether the server confirmed the
+	// callback, which OAuth 1.0a servers always do.
+	CallbackConfirmed bool
+}
+
+// OAuthFlow implements the three-legged OAuth 1.0a flow in which the
+// user authorizes a client in their web browser, without giving the
+// client their password. The flow is:
+//
+//  1. call RequestToken to obtain temporary credentials;
+//  2. send the user to the URL returned by AuthorizationURL;
+//  3. call AccessToken with the verifier given to the callback, or
+//     shown to the user, to obtain the token credentials.
+type OAuthFlow struct {
+	// ConsumerKey holds the client's consumer key.
+	ConsumerKey string
+
+	// ConsumerSecret holds the client's consumer secret.
+	ConsumerSecret string
+
+	// Realm holds the realm of the resulting SSOData.
+	Realm string
+
+	// Endpoints holds the URLs of the server's endpoints.
+	Endpoints OAuthEndpoints
+
+	// Callback holds the URL the server redirects the user to after
+	// authorization. If it is empty then "oob" is used, which asks
+	// the server to show the verifier to the user instead.
+	Callback string
+
+	// SignatureMethod holds the method used to sign requests. If it
+	// is nil then HMACSHA1 is used.
+	SignatureMethod SignatureMethod
+
+	// Transmission selects how the OAuth parameters are sent.
+	Transmission ParameterTransmission
+
+	// Strict selects strict conformance with RFC 5849, see
+	// RequestParameters.Strict.
+	Strict bool
+
+	// Client holds the HTTP client used to make requests. If it is
+	// nil then http.DefaultClient is used.
+	Client *http.Client
+}
+
+// RequestToken obtains temporary credentials from the server, see
+// http://tools.ietf.org/html/rfc5849#section-2.1. If an error is
+// returned from the server then it will be of type *Error.
+func (f *OAuthFlow) RequestToken(ctx context.Context) (*RequestToken, error) {
+	callback := f.Callback
+	if callback == "" {
+		callback = "oob"
+	}
+	ssodata := f.ssoData("", "")
+	resp, err := f.post(ctx, f.Endpoints.RequestTokenURL, ssodata, url.Values{
+		"oauth_callback": {callback},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Get("oauth_token") == "" {
+		return nil, errors.New("no oauth_token in request token response")
+	}
+	return &RequestToken{
+		Token:             resp.Get("oauth_token"),
+		Secret:            resp.Get("oauth_token_secret"),
+		CallbackConfirmed: resp.Get("oauth_callback_confirmed") == "true",
+	}, nil
+}
+
+// AuthorizationURL returns the URL the user should visit to authorize
+// the given temporary credentials, see
+// http://tools.ietf.org/html/rfc5849#section-2.2. Servers that did not
+// confirm the callback implement OAuth 1.0, so the callback is included
+// in the URL as that version requires.
+func (f *OAuthFlow) AuthorizationURL(rt *RequestToken) string {
+	v := url.Values{"oauth_token": {rt.Token}}
+	if !rt.CallbackConfirmed && f.Callback != "" {
+		v.Set("oauth_callback", f.Callback)
+	}
+	sep := "?"
+	if strings.Contains(f.Endpoints.AuthorizeURL, "?") {
+		sep = "&"
+	}
+	return f.Endpoints.AuthorizeURL + sep + v.Encode()
+}
+
+// CallbackVerifier extracts the verifier from the query parameters of
+// the request made to the callback URL, checking that it is for the
+// given temporary credentials.
+func CallbackVerifier(rt *RequestToken, query url.Values) (string, error) {
+	if token := query.Get("oauth_token"); token != rt.Token {
+		return "", fmt.Errorf("callback for unexpected token %q", token)
+	}
+	return query.Get("oauth_verifier"), nil
+}
+
+// AccessToken exchanges the authorized temporary credentials for token
+// credentials, see http://tools.ietf.org/html/rfc5849#section-2.3. The
+// verifier is required by OAuth 1.0a servers. If an error is returned
+// from the server then it will be of type *Error.
+func (f *OAuthFlow) AccessToken(ctx context.Context, rt *RequestToken, verifier string) (*SSOData, error) {
+	params := url.Values{}
+	if verifier != "" {
+		params.Set("oauth_verifier", verifier)
+	}
+	resp, err := f.post(ctx, f.Endpoints.AccessTokenURL, f.ssoData(rt.Token, rt.Secret), params)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Get("oauth_token") == "" {
+		return nil, errors.New("no oauth_token in access token response")
+	}
+	return f.ssoData(resp.Get("oauth_token"), resp.Get("oauth_token_secret")), nil
+}
+
+func (f *OAuthFlow) ssoData(token, secret string) *SSOData {
+	return &SSOData{
+		ConsumerKey:    f.ConsumerKey,
+		ConsumerSecret: f.ConsumerSecret,
+		Realm:          f.Realm,
+		TokenKey:       token,
+		TokenSecret:    secret,
+	}
+}
+
+// post sends a signed POST request to the given URL and decodes the
+// form-encoded response.
+func (f *OAuthFlow) post(ctx context.Context, u string, ssodata *SSOData, params url.Values) (url.Values, error) {
+	sm := f.SignatureMethod
+	if sm == nil {
+		sm = HMACSHA1{}
+	}
+	rp := RequestParameters{
+		HTTPMethod:      "POST",
+		BaseURL:         u,
+		Params:          params,
+		SignatureMethod: sm,
+		Strict:          f.Strict,
+		Transmission:    f.Transmission,
+	}
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ssodata.SignRequest(&rp, req); err != nil {
+		return nil, err
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	DefaultClockSkew.Observe(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, getError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(body))
+}
+
+// RequestTokenURL returns the URL where temporary credentials for the
+// three-legged OAuth flow can be requested.
+func (server UbuntuSSOServer) RequestTokenURL() string {
+	return server.baseUrl + "/+request-token"
+}
+
+// AuthorizeTokenURL returns the URL where the user authorizes temporary
+// credentials in the three-legged OAuth flow.
+func (server UbuntuSSOServer) AuthorizeTokenURL() string {
+	return server.baseUrl + "/+authorize-token"
+}
+
+// AccessTokenURL returns the URL where authorized temporary credentials
+// are exchanged for token credentials in the three-legged OAuth flow.
+func (server UbuntuSSOServer) AccessTokenURL() string {
+	return server.baseUrl + "/+access-token"
+}
+
+// TokenRegistrationURL returns the URL that the user is sent to after
+// authorizing a token, unless another callback is given.
+func (server UbuntuSSOServer) TokenRegistrationURL() string {
+	return server.tokenRegistrationUrl
+}
+
+// OAuthFlow returns an OAuthFlow for obtaining a token from the server
+// for the given consumer. The callback defaults to the server's token
+// registration URL, if it has one.
+func (server UbuntuSSOServer) OAuthFlow(consumerKey, consumerSecret string) *OAuthFlow {
+	return &OAuthFlow{
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+		Realm:          "API",
+		Endpoints: OAuthEndpoints{
+			RequestTokenURL: server.RequestTokenURL(),
+			AuthorizeURL:    server.AuthorizeTokenURL(),
+			AccessTokenURL:  server.AccessTokenURL(),
+		},
+		Callback:        server.tokenRegistrationUrl,
+		SignatureMethod: HMACSHA1{},
+		Client:          server.Client,
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// oauthProvider implements the three-legged OAuth flow for the test
+// consumer, checking the signature of every request.
+type oauthProvider struct {
+	c *qt.C
+}
+
+func (p oauthProvider) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := p.c
+	params := parseAuthorizationHeader(c, req.Header.Get("Authorization"))
+	ssodata := SSOData{
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+	}
+	rp := RequestParameters{
+		HTTPMethod:      req.Method,
+		BaseURL:         "http://" + req.Host + req.URL.Path,
+		Params:          url.Values{},
+		Nonce:           params["oauth_nonce"],
+		Timestamp:       params["oauth_timestamp"],
+		SignatureMethod: HMACSHA1{},
+	}
+	switch req.URL.Path {
+	case "/+request-token":
+		c.Check(params["oauth_token"], qt.Equals, "")
+		rp.Params.Set("oauth_callback", params["oauth_callback"])
+	case "/+access-token":
+		if params["oauth_token"] != "request-token" || params["oauth_verifier"] != "verifier" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		ssodata.TokenKey = "request-token"
+		ssodata.TokenSecret = "request-secret"
+		rp.Params.Set("oauth_verifier", params["oauth_verifier"])
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	sig, err := HMACSHA1{}.Signature(&ssodata, &rp)
+	c.Check(err, qt.IsNil)
+	if sig != params["oauth_signature"] {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	switch req.URL.Path {
+	case "/+request-token":
+		if params["oauth_callback"] == "oob" {
+			w.Write([]byte("oauth_token=request-token&oauth_token_secret=request-secret&oauth_callback_confirmed=true"))
+		} else {
+			w.Write([]byte("oauth_token=request-token&oauth_token_secret=request-secret"))
+		}
+	case "/+access-token":
+		w.Write([]byte("oauth_token=" + tokenKey + "&oauth_token_secret=" + tokenSecret))
+	}
+}
+
+func TestOAuthFlow(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(oauthProvider{c})
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	flow := server.OAuthFlow(consumerKey, consumerSecret)
+	flow.Callback = ""
+	ctx := context.Background()
+
+	rt, err := flow.RequestToken(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rt, qt.DeepEquals, &RequestToken{
+		Token:             "request-token",
+		Secret:            "request-secret",
+		CallbackConfirmed: true,
+	})
+	c.Assert(flow.AuthorizationURL(rt), qt.Equals, srv.URL+"/+authorize-token?oauth_token=request-token")
+
+	callback, err := url.ParseQuery("oauth_token=request-token&oauth_verifier=verifier")
+	c.Assert(err, qt.IsNil)
+	verifier, err := CallbackVerifier(rt, callback)
+	c.Assert(err, qt.IsNil)
+	c.Assert(verifier, qt.Equals, "verifier")
+
+	ssodata, err := flow.AccessToken(ctx, rt, verifier)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata, qt.DeepEquals, &SSOData{
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+		Realm:          realm,
+		TokenKey:       tokenKey,
+		TokenSecret:    tokenSecret,
+	})
+}
+
+// An OAuth 1.0 server does not confirm the callback, so it is added to
+// the authorization URL.
+func TestOAuthFlowUnconfirmedCallback(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(oauthProvider{c})
+	defer srv.Close()
+	server := UbuntuSSOServer{
+		baseUrl:              srv.URL,
+		tokenRegistrationUrl: "https://example.com/done",
+	}
+	flow := server.OAuthFlow(consumerKey, consumerSecret)
+	rt, err := flow.RequestToken(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(rt.CallbackConfirmed, qt.Equals, false)
+	c.Assert(flow.AuthorizationURL(rt), qt.Equals, srv.URL+"/+authorize-token?oauth_callback=https%3A%2F%2Fexample.com%2Fdone&oauth_token=request-token")
+}
+
+func TestOAuthFlowAccessTokenError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(oauthProvider{c})
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	flow := server.OAuthFlow(consumerKey, consumerSecret)
+	rt := &RequestToken{
+		Token:  "request-token",
+		Secret: "request-secret",
+	}
+	_, err := flow.AccessToken(context.Background(), rt, "wrong")
+	c.Assert(err, qt.ErrorMatches, "invalid token\n")
+	c.Assert(err.(*Error).Code, qt.Equals, "401 Unauthorized")
+}
+
+func TestCallbackVerifierWrongToken(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := CallbackVerifier(&RequestToken{Token: "a"}, url.Values{"oauth_token": {"b"}})
+	c.Assert(err, qt.ErrorMatches, `callback for unexpected token "b"`)
+}
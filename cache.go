@@ -0,0 +1,221 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// TokenCache caches the results of checking whether tokens are valid,
+// so that a token used for many requests is only checked with the
+// server occasionally. Valid and invalid results are cached for
+// different times; errors are never cached. Concurrent checks of the
+// same credentials share a single request to the server. A TokenCache
+// must be created with NewTokenCache and is safe for concurrent use.
+type TokenCache struct {
+	server     UbuntuSSOServer
+	validTTL   time.Duration
+	invalidTTL time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	calls   map[[sha256.Size]byte]*cacheCall
+	stats   CacheStats
+}
+
+// CacheStats holds counters describing the use of a TokenCache.
+type CacheStats struct {
+	// Hits holds the number of checks answered from the cache.
+	Hits int64
+
+	// Misses holds the number of checks that sent a request to the
+	// server.
+	Misses int64
+
+	// Shared holds the number of checks that waited for a request
+	// already sent by another check of the same credentials.
+	Shared int64
+
+	// Evictions holds the number of entries removed to keep the cache
+	// within its maximum size.
+	Evictions int64
+
+	// Entries holds the number of entries currently in the cache.
+	Entries int
+}
+
+// cacheEntry holds a cached result.
+type cacheEntry struct {
+	key      [sha256.Size]byte
+	tokenKey string
+	valid    bool
+	err      error
+	expires  time.Time
+}
+
+// cacheCall holds a check in progress.
+type cacheCall struct {
+	done     chan struct{}
+	tokenKey string
+	valid    bool
+	err      error
+
+	// invalidated records that the token was invalidated while the
+	// check was in progress, so its result must not be cached.
+	invalidated bool
+}
+
+// NewTokenCache returns a cache that checks tokens with the given
+// server. Valid results are cached for validTTL and invalid results for
+// invalidTTL; a TTL of zero disables caching of those results. If
+// maxEntries is greater than zero then the least recently used entries
+// are evicted to keep the cache no larger than that.
+func NewTokenCache(server UbuntuSSOServer, validTTL, invalidTTL time.Duration, maxEntries int) *TokenCache {
+	return &TokenCache{
+		server:     server,
+		validTTL:   validTTL,
+		invalidTTL: invalidTTL,
+		maxEntries: maxEntries,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+		calls:      make(map[[sha256.Size]byte]*cacheCall),
+	}
+}
+
+// cacheKey returns the key used to cache the result for the given
+// credentials. It includes the secrets so that credentials with a known
+// token key but the wrong secret are not reported valid from the cache.
+func cacheKey(ssodata *SSOData) [sha256.Size]byte {
+	h := sha256.New()
+	for _, s := range []string{ssodata.ConsumerKey, ssodata.ConsumerSecret, ssodata.TokenKey, ssodata.TokenSecret} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// IsTokenValid is like UbuntuSSOServer.IsTokenValidContext but returns
+// a cached result if there is one. If another check of the same
+// credentials is in progress then its result is returned instead of
+// sending another request; if the context of that check is cancelled
+// its error is returned to every waiting check.
+func (c *TokenCache) IsTokenValid(ctx context.Context, ssodata *SSOData) (bool, error) {
+	key := cacheKey(ssodata)
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return entry.valid, entry.err
+		}
+		c.remove(e)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.valid, call.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	call := &cacheCall{
+		done:     make(chan struct{}),
+		tokenKey: ssodata.TokenKey,
+	}
+	c.calls[key] = call
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	call.valid, call.err = c.server.IsTokenValidContext(ctx, ssodata)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	var ttl time.Duration
+	switch tokenStatus(call.valid, call.err) {
+	case TokenValid:
+		ttl = c.validTTL
+	case TokenInvalid:
+		ttl = c.invalidTTL
+	}
+	if ttl > 0 && !call.invalidated {
+		c.add(&cacheEntry{
+			key:      key,
+			tokenKey: ssodata.TokenKey,
+			valid:    call.valid,
+			err:      call.err,
+			expires:  now().Add(ttl),
+		})
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.valid, call.err
+}
+
+// add adds an entry to the cache, evicting the least recently used
+// entries if necessary. It must be called with c.mu held.
+func (c *TokenCache) add(entry *cacheEntry) {
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove removes an entry from the cache. It must be called with c.mu
+// held.
+func (c *TokenCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// Invalidate removes any cached results for the token with the given
+// key, so that the next check is sent to the server. The results of
+// checks in progress are not cached.
+func (c *TokenCache) Invalidate(tokenKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, call := range c.calls {
+		if call.tokenKey == tokenKey {
+			call.invalidated = true
+		}
+	}
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cacheEntry).tokenKey == tokenKey {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// RevokeToken is like UbuntuSSOServer.RevokeToken but also invalidates
+// any cached results for the token.
+func (c *TokenCache) RevokeToken(ctx context.Context, ssodata *SSOData, key string) error {
+	defer c.Invalidate(key)
+	return c.server.RevokeToken(ctx, ssodata, key)
+}
+
+// Stats returns the current counters for the cache.
+func (c *TokenCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
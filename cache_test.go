@@ -0,0 +1,155 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTokenCacheTTLs(t *testing.T) {
+	c := qt.New(t)
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := epoch
+	c.Patch(&now, func() time.Time { return clock })
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, 10*time.Second, 0)
+	ctx := context.Background()
+	tokens := tokensWithKeys("good", "bad", "broken")
+
+	check := func(ssodata *SSOData, expectValid bool, expectError string) {
+		valid, err := cache.IsTokenValid(ctx, ssodata)
+		c.Assert(valid, qt.Equals, expectValid)
+		if expectError == "" {
+			c.Assert(err, qt.IsNil)
+		} else {
+			c.Assert(err, qt.ErrorMatches, expectError)
+		}
+	}
+	check(tokens[0], true, "")
+	check(tokens[1], false, "INVALID_CREDENTIALS")
+	check(tokens[2], false, "INVALID_CREDENTIALS")
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Misses: 3, Entries: 2})
+
+	check(tokens[0], true, "")
+	check(tokens[1], false, "INVALID_CREDENTIALS")
+	check(tokens[2], false, "INVALID_CREDENTIALS")
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Hits: 2, Misses: 4, Entries: 2})
+
+	// The invalid result expires first.
+	clock = epoch.Add(30 * time.Second)
+	check(tokens[0], true, "")
+	check(tokens[1], false, "INVALID_CREDENTIALS")
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Hits: 3, Misses: 5, Entries: 2})
+
+	clock = epoch.Add(2 * time.Minute)
+	check(tokens[0], true, "")
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Hits: 3, Misses: 6, Entries: 2})
+}
+
+func TestTokenCacheDistinguishesSecrets(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, time.Minute, 0)
+	tokens := tokensWithKeys("good", "good")
+	tokens[1].TokenSecret = "wrong"
+	for _, ssodata := range tokens {
+		_, err := cache.IsTokenValid(context.Background(), ssodata)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Misses: 2, Entries: 2})
+}
+
+func TestTokenCacheLRU(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, time.Minute, 2)
+	ctx := context.Background()
+	tokens := tokensWithKeys("good1", "good2", "good3")
+	for _, ssodata := range []*SSOData{tokens[0], tokens[1], tokens[0], tokens[2], tokens[0], tokens[1]} {
+		valid, err := cache.IsTokenValid(ctx, ssodata)
+		c.Assert(err, qt.IsNil)
+		c.Assert(valid, qt.IsTrue)
+	}
+	// good2 is evicted when good3 is added, good3 when good2 is
+	// added back.
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Hits: 2, Misses: 4, Evictions: 2, Entries: 2})
+}
+
+func TestTokenCacheSharesConcurrentChecks(t *testing.T) {
+	c := qt.New(t)
+
+	h := &validationServer{delay: 50 * time.Millisecond}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, time.Minute, 0)
+	ssodata := tokensWithKeys("good")[0]
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valid, err := cache.IsTokenValid(context.Background(), ssodata)
+			c.Check(err, qt.IsNil)
+			c.Check(valid, qt.IsTrue)
+		}()
+	}
+	wg.Wait()
+	stats := cache.Stats()
+	c.Assert(stats.Misses, qt.Equals, int64(1))
+	c.Assert(stats.Hits+stats.Shared, qt.Equals, int64(9))
+	c.Assert(h.maxConcurrent, qt.Equals, 1)
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, time.Minute, 0)
+	ctx := context.Background()
+	tokens := tokensWithKeys("good1", "good2")
+	for _, ssodata := range tokens {
+		_, err := cache.IsTokenValid(ctx, ssodata)
+		c.Assert(err, qt.IsNil)
+	}
+	cache.Invalidate("good1")
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Misses: 2, Entries: 1})
+	for _, ssodata := range tokens {
+		_, err := cache.IsTokenValid(ctx, ssodata)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(cache.Stats(), qt.DeepEquals, CacheStats{Hits: 1, Misses: 3, Entries: 2})
+}
+
+func TestTokenCacheRevokeToken(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&tokensServer{
+		c:      c,
+		tokens: append([]map[string]string(nil), testTokens...),
+	})
+	defer srv.Close()
+	cache := NewTokenCache(UbuntuSSOServer{baseUrl: srv.URL}, time.Minute, time.Minute, 0)
+	cache.add(&cacheEntry{
+		key:      cacheKey(testSSOData),
+		tokenKey: "old",
+		valid:    true,
+		expires:  now().Add(time.Minute),
+	})
+	err := cache.RevokeToken(context.Background(), testSSOData, "old")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cache.Stats().Entries, qt.Equals, 0)
+}
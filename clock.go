@@ -0,0 +1,142 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSkew records the offsets between the local clock and the clocks
+// of remote servers. The offsets are used to correct the oauth_timestamp
+// of requests sent from hosts with drifting clocks, which would
+// otherwise be refused. A ClockSkew is safe for concurrent use.
+type ClockSkew struct {
+	mu      sync.Mutex
+	offsets map[string]time.Duration
+}
+
+// DefaultClockSkew holds the offsets learned from the responses to
+// requests made by this package. It is used to calculate the timestamp
+// of any request signed without an explicit Timestamp.
+var DefaultClockSkew = new(ClockSkew)
+
+// now is the function used to get the local time. It is a variable so
+// that it can be replaced in tests.
+var now = time.Now
+
+// Offset returns the measured offset of the clock on the given host
+// from the local clock. A positive offset means the server's clock is
+// ahead of the local clock. The host is a host name with an optional
+// port, as in url.URL.Host.
+func (s *ClockSkew) Offset(host string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offsets[strings.ToLower(host)]
+}
+
+// SetOffset sets the offset of the clock on the given host from the
+// local clock.
+func (s *ClockSkew) SetOffset(host string, offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.offsets == nil {
+		s.offsets = make(map[string]time.Duration)
+	}
+	s.offsets[strings.ToLower(host)] = offset
+}
+
+// Offsets returns the offsets of all the hosts that have been measured,
+// keyed by host.
+func (s *ClockSkew) Offsets() map[string]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offsets := make(map[string]time.Duration, len(s.offsets))
+	for k, v := range s.offsets {
+		offsets[k] = v
+	}
+	return offsets
+}
+
+// Now returns the current time according to the clock on the given
+// host.
+func (s *ClockSkew) Now(host string) time.Time {
+	return now().Add(s.Offset(host))
+}
+
+// maxDateSkew is the difference between the offset measured from a
+// Date header and the recorded offset below which the recorded offset
+// is kept. Servers accept timestamps within a few minutes of their own
+// clock, so smaller differences, which are mostly caused by the
+// resolution of the Date header and network latency, do not matter.
+const maxDateSkew = 30 * time.Second
+
+// Observe updates the offset of the server that sent resp. If the
+// server refused the request's timestamp, as described in
+// http://wiki.oauth.net/w/page/12238543/ProblemReporting, the offset is
+// set so that timestamps fall in the middle of the acceptable range.
+// Otherwise the offset is measured from the response's Date header, and
+// only recorded if it differs from the recorded offset by at least 30
+// seconds. Responses with an Age header were served from a cache and
+// their Date header is ignored.
+func (s *ClockSkew) Observe(resp *http.Response) {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return
+	}
+	host := resp.Request.URL.Host
+	t := now()
+	if min, max, ok := acceptableTimestamps(resp.Header.Get("WWW-Authenticate")); ok {
+		mid := time.Unix((min+max)/2, 0)
+		s.SetOffset(host, mid.Sub(t).Truncate(time.Second))
+		return
+	}
+	if resp.Header.Get("Age") != "" {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	offset := date.Sub(t).Round(time.Second)
+	if d := offset - s.Offset(host); d > -maxDateSkew && d < maxDateSkew {
+		return
+	}
+	s.SetOffset(host, offset)
+}
+
+var authParamRE = regexp.MustCompile(`([a-zA-Z_]+)="([^"]*)"`)
+
+// acceptableTimestamps extracts the range in a timestamp_refused
+// problem report from a WWW-Authenticate header.
+func acceptableTimestamps(h string) (min, max int64, ok bool) {
+	params := make(map[string]string)
+	for _, m := range authParamRE.FindAllStringSubmatch(h, -1) {
+		v, err := url.QueryUnescape(m[2])
+		if err != nil {
+			continue
+		}
+		params[m[1]] = v
+	}
+	if params["oauth_problem"] != "timestamp_refused" {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(params["oauth_acceptable_timestamps"], "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	min, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	max, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || max < min {
+		return 0, 0, false
+	}
+	return min, max, true
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var epoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var observeTests = []struct {
+	about        string
+	header       http.Header
+	expectOffset time.Duration
+}{{
+	about:        "no date",
+	header:       http.Header{},
+	expectOffset: 0,
+}, {
+	about:        "server ahead",
+	header:       http.Header{"Date": {epoch.Add(5 * time.Minute).Format(http.TimeFormat)}},
+	expectOffset: 5 * time.Minute,
+}, {
+	about:        "server behind",
+	header:       http.Header{"Date": {epoch.Add(-90 * time.Second).Format(http.TimeFormat)}},
+	expectOffset: -90 * time.Second,
+}, {
+	about:        "within date resolution",
+	header:       http.Header{"Date": {epoch.Format(http.TimeFormat)}},
+	expectOffset: 0,
+}, {
+	about:        "small offset",
+	header:       http.Header{"Date": {epoch.Add(-20 * time.Second).Format(http.TimeFormat)}},
+	expectOffset: 0,
+}, {
+	about: "cached response",
+	header: http.Header{
+		"Date": {epoch.Add(-time.Hour).Format(http.TimeFormat)},
+		"Age":  {"3600"},
+	},
+	expectOffset: 0,
+}, {
+	about: "timestamp refused",
+	header: http.Header{
+		"Date":             {epoch.Format(http.TimeFormat)},
+		"Www-Authenticate": {`OAuth realm="API", oauth_problem="timestamp_refused", oauth_acceptable_timestamps="` + strconv.FormatInt(epoch.Unix()+600, 10) + "-" + strconv.FormatInt(epoch.Unix()+1200, 10) + `"`},
+	},
+	expectOffset: 15 * time.Minute,
+}, {
+	about: "other problem",
+	header: http.Header{
+		"Date":             {epoch.Add(time.Hour).Format(http.TimeFormat)},
+		"Www-Authenticate": {`OAuth oauth_problem="nonce_used"`},
+	},
+	expectOffset: time.Hour,
+}}
+
+func TestClockSkewObserve(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&now, func() time.Time { return epoch })
+
+	for _, test := range observeTests {
+		c.Run(test.about, func(c *qt.C) {
+			var skew ClockSkew
+			resp := &http.Response{
+				Header: test.header,
+				Request: &http.Request{
+					URL: &url.URL{Scheme: "https", Host: "Login.Example.com"},
+				},
+			}
+			skew.Observe(resp)
+			c.Assert(skew.Offset("login.example.com"), qt.Equals, test.expectOffset)
+			c.Assert(skew.Now("login.example.com"), qt.Equals, epoch.Add(test.expectOffset))
+			c.Assert(skew.Offset("other.example.com"), qt.Equals, time.Duration(0))
+		})
+	}
+}
+
+// An offset is only replaced when the Date header differs from it
+// significantly.
+func TestClockSkewObserveKeepsOffset(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&now, func() time.Time { return epoch })
+
+	var skew ClockSkew
+	observe := func(date time.Time) {
+		skew.Observe(&http.Response{
+			Header: http.Header{"Date": {date.Format(http.TimeFormat)}},
+			Request: &http.Request{
+				URL: &url.URL{Scheme: "https", Host: "login.example.com"},
+			},
+		})
+	}
+	skew.SetOffset("login.example.com", 5*time.Minute)
+	observe(epoch.Add(5*time.Minute + 2*time.Second))
+	c.Assert(skew.Offset("login.example.com"), qt.Equals, 5*time.Minute)
+	observe(epoch.Add(-time.Second))
+	c.Assert(skew.Offset("login.example.com"), qt.Equals, -time.Second)
+}
+
+func TestClockSkewOffsets(t *testing.T) {
+	c := qt.New(t)
+
+	var skew ClockSkew
+	c.Assert(skew.Offsets(), qt.DeepEquals, map[string]time.Duration{})
+	skew.SetOffset("a.example.com", time.Minute)
+	skew.SetOffset("B.example.com:8080", -time.Minute)
+	c.Assert(skew.Offsets(), qt.DeepEquals, map[string]time.Duration{
+		"a.example.com":      time.Minute,
+		"b.example.com:8080": -time.Minute,
+	})
+}
+
+// The measured offset is applied to the timestamps of requests to the
+// same server.
+func TestTimestampUsesOffset(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&now, func() time.Time { return epoch })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Date", epoch.Add(-time.Hour).Format(http.TimeFormat))
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	DefaultClockSkew.Observe(resp)
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	defer DefaultClockSkew.SetOffset(u.Host, 0)
+
+	ssodata, _, _ := defaults(c)
+	rp := RequestParameters{
+		HTTPMethod:      "GET",
+		BaseURL:         srv.URL + "/path",
+		SignatureMethod: HMACSHA1{},
+	}
+	_, err = ssodata.GetAuthorizationHeader(&rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rp.Timestamp, qt.Equals, strconv.FormatInt(epoch.Add(-time.Hour).Unix(), 10))
+
+	rp = RequestParameters{
+		HTTPMethod:      "GET",
+		BaseURL:         "https://other.example.com/path",
+		SignatureMethod: HMACSHA1{},
+	}
+	_, err = ssodata.GetAuthorizationHeader(&rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rp.Timestamp, qt.Equals, strconv.FormatInt(epoch.Unix(), 10))
+}
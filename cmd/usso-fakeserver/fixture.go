@@ -0,0 +1,127 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/usso/openid"
+	"github.com/juju/usso/openid/openidtest"
+	"github.com/juju/usso/ussotest"
+)
+
+// fixture holds the contents of a fixture file.
+type fixture struct {
+	// OpenID holds the email address of the user logged in by the
+	// OpenID provider.
+	OpenID string `yaml:"openid"`
+
+	// Users holds the users known to the server.
+	Users []fixtureUser `yaml:"users"`
+}
+
+// fixtureUser holds the details of a user in a fixture file.
+type fixtureUser struct {
+	Email          string         `yaml:"email"`
+	Password       string         `yaml:"password"`
+	DisplayName    string         `yaml:"displayname"`
+	Username       string         `yaml:"username"`
+	OpenID         string         `yaml:"openid"`
+	ConsumerSecret string         `yaml:"consumer_secret"`
+	OTPSeed        string         `yaml:"otp_seed"`
+	Suspended      bool           `yaml:"suspended"`
+	Teams          []string       `yaml:"teams"`
+	Tokens         []fixtureToken `yaml:"tokens"`
+}
+
+// fixtureToken holds the details of a token in a fixture file.
+type fixtureToken struct {
+	Name   string `yaml:"name"`
+	Key    string `yaml:"key"`
+	Secret string `yaml:"secret"`
+}
+
+// parse parses the fixture from the given YAML or JSON data.
+func (f *fixture) parse(data []byte) error {
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return errgo.Mask(err)
+	}
+	emails := make(map[string]bool)
+	for _, u := range f.Users {
+		if u.Email == "" {
+			return errgo.New("user with no email address")
+		}
+		if emails[u.Email] {
+			return errgo.Newf("duplicate user %q", u.Email)
+		}
+		emails[u.Email] = true
+		if _, err := u.otpSeed(); err != nil {
+			return errgo.Notef(err, "invalid otp_seed for %q", u.Email)
+		}
+	}
+	if f.OpenID != "" && !emails[f.OpenID] {
+		return errgo.Newf("openid user %q not found", f.OpenID)
+	}
+	return nil
+}
+
+// otpSeed returns the decoded OTP seed of the user.
+func (u fixtureUser) otpSeed() ([]byte, error) {
+	if u.OTPSeed == "" {
+		return nil, nil
+	}
+	seed := strings.ToUpper(strings.Replace(u.OTPSeed, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(seed, "="))
+}
+
+// newHandler returns a handler that serves the fake SSO API and OpenID
+// provider populated from f.
+func newHandler(f *fixture) (http.Handler, error) {
+	sso := ussotest.NewHandler()
+	var identity openidtest.Identity
+	for i, u := range f.Users {
+		seed, err := u.otpSeed()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		user := sso.AddUser(ussotest.User{
+			Email:          u.Email,
+			Password:       u.Password,
+			DisplayName:    u.DisplayName,
+			Username:       u.Username,
+			OpenID:         u.OpenID,
+			ConsumerSecret: u.ConsumerSecret,
+			OTPSeed:        seed,
+			Suspended:      u.Suspended,
+		})
+		for _, t := range u.Tokens {
+			sso.AddTokenCredentials(u.Email, t.Name, t.Key, t.Secret)
+		}
+		if u.Email == f.OpenID || (f.OpenID == "" && i == 0) {
+			identity = openidtest.Identity{
+				ID:    user.OpenID,
+				Teams: u.Teams,
+				SReg:  make(map[string]string),
+			}
+			for k, v := range map[string]string{
+				openid.SRegEmail:    u.Email,
+				openid.SRegFullName: u.DisplayName,
+				openid.SRegNickname: u.Username,
+			} {
+				if v != "" {
+					identity.SReg[k] = v
+				}
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/+openid", openidtest.NewHandler(identity))
+	mux.Handle("/", sso)
+	return mux, nil
+}
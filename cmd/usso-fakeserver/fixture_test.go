@@ -0,0 +1,171 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/openid"
+	"github.com/juju/usso/ussotest"
+)
+
+const testFixture = `
+openid: alice@example.com
+users:
+  - email: bob@example.com
+    password: bob-password
+    suspended: true
+  - email: alice@example.com
+    password: alice-password
+    displayname: Alice
+    username: alice
+    openid: alice-id
+    consumer_secret: alice-consumer-secret
+    otp_seed: JBSWY3DPEHPK3PXP
+    teams: [admins, developers]
+    tokens:
+      - name: ci
+        key: alice-token-key
+        secret: alice-token-secret
+`
+
+func newTestHandler(c *qt.C, data string) http.Handler {
+	var f fixture
+	err := f.parse([]byte(data))
+	c.Assert(err, qt.IsNil)
+	h, err := newHandler(&f)
+	c.Assert(err, qt.IsNil)
+	return h
+}
+
+func TestFixtureTokens(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(newTestHandler(c, testFixture))
+	defer srv.Close()
+	server := usso.NewUbuntuSSOServer(srv.URL, "")
+	ssodata := &usso.SSOData{
+		ConsumerKey:    "alice-id",
+		ConsumerSecret: "alice-consumer-secret",
+		TokenKey:       "alice-token-key",
+		TokenSecret:    "alice-token-secret",
+	}
+	valid, err := server.IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+
+	_, err = server.GetToken("alice@example.com", "alice-password", "new")
+	c.Assert(err, qt.ErrorMatches, "2-factor authentication required.")
+	seed := []byte("Hello!\xde\xad\xbe\xef")
+	_, err = server.GetTokenWithOTP("alice@example.com", "alice-password", ussotest.TOTP(seed, time.Now()), "new")
+	c.Assert(err, qt.IsNil)
+
+	_, err = server.GetToken("bob@example.com", "bob-password", "new")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeAccountSuspended)
+}
+
+func TestFixtureAccounts(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(newTestHandler(c, testFixture))
+	defer srv.Close()
+	server := usso.NewUbuntuSSOServer(srv.URL, "")
+	ctx := context.Background()
+	_, err := server.RegisterAccount(ctx, "alice@example.com", "password", "Alice", "", "")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeAlreadyRegistered)
+	account, err := server.RegisterAccount(ctx, "carol@example.com", "carol-password", "Carol", "", "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(account.Email, qt.Equals, "carol@example.com")
+	_, err = server.GetToken("carol@example.com", "carol-password", "new")
+	c.Assert(err, qt.IsNil)
+
+	err = server.RequestPasswordReset(ctx, "carol@example.com")
+	c.Assert(err, qt.IsNil)
+	err = server.RequestPasswordReset(ctx, "bob@example.com")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeCanNotResetPassword)
+}
+
+func TestFixtureOpenID(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(newTestHandler(c, testFixture))
+	defer srv.Close()
+	client := openid.NewClient(usso.NewUbuntuSSOServer(srv.URL, ""), nil, nil)
+	var resp *openid.Response
+	var verifyErr error
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp, verifyErr = client.Verify("http://" + req.Host + req.URL.RequestURI())
+	}))
+	defer callback.Close()
+	httpResp, err := http.Get(client.RedirectURL(&openid.Request{
+		ReturnTo:     callback.URL + "/callback",
+		Teams:        []string{"admins", "others"},
+		SRegRequired: []string{openid.SRegEmail, openid.SRegNickname},
+	}))
+	c.Assert(err, qt.IsNil)
+	httpResp.Body.Close()
+	c.Assert(verifyErr, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &openid.Response{
+		ID:    srv.URL + "/+id/alice-id",
+		Teams: []string{"admins"},
+		SReg: map[string]string{
+			openid.SRegEmail:    "alice@example.com",
+			openid.SRegNickname: "alice",
+		},
+	})
+}
+
+func TestFixtureJSON(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(newTestHandler(c, `{"users": [{"email": "alice@example.com", "password": "pw"}]}`))
+	defer srv.Close()
+	_, err := usso.NewUbuntuSSOServer(srv.URL, "").GetToken("alice@example.com", "pw", "new")
+	c.Assert(err, qt.IsNil)
+}
+
+var parseErrorTests = []struct {
+	about       string
+	data        string
+	expectError string
+}{{
+	about:       "unknown field",
+	data:        "users: [{email: a@example.com, pasword: x}]",
+	expectError: `(?s)yaml: unmarshal errors:.*field pasword not found.*`,
+}, {
+	about:       "no email",
+	data:        "users: [{password: x}]",
+	expectError: `user with no email address`,
+}, {
+	about:       "duplicate",
+	data:        "users: [{email: a@example.com}, {email: a@example.com}]",
+	expectError: `duplicate user "a@example.com"`,
+}, {
+	about:       "bad seed",
+	data:        "users: [{email: a@example.com, otp_seed: '!!!'}]",
+	expectError: `invalid otp_seed for "a@example.com": .*`,
+}, {
+	about:       "unknown openid user",
+	data:        "openid: b@example.com\nusers: [{email: a@example.com}]",
+	expectError: `openid user "b@example.com" not found`,
+}}
+
+func TestParseErrors(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range parseErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			var f fixture
+			err := f.parse([]byte(test.data))
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
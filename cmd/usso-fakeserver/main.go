@@ -0,0 +1,89 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+// The usso-fakeserver command runs a fake Ubuntu SSO server for use in
+// tests of programs that are not written in Go. It serves the token,
+// token details, account, registration and password reset endpoints of
+// the v2 API and an OpenID provider at /+openid, populated from a
+// fixture file.
+//
+// Usage:
+//
+//	usso-fakeserver [-addr host:port] [fixture]
+//
+// Once the server is listening its base URL is printed on standard
+// output, followed by a newline, so that scripts can read it. The server
+// runs until it is interrupted.
+//
+// The fixture file is YAML, or JSON which YAML is a superset of. For
+// example:
+//
+//	openid: alice@example.com
+//	users:
+//	  - email: alice@example.com
+//	    password: alice-password
+//	    displayname: Alice
+//	    username: alice
+//	    openid: alice-id
+//	    consumer_secret: alice-consumer-secret
+//	    otp_seed: JBSWY3DPEHPK3PXP
+//	    teams: [admins, developers]
+//	    tokens:
+//	      - name: ci
+//	        key: alice-token-key
+//	        secret: alice-token-secret
+//	  - email: bob@example.com
+//	    password: bob-password
+//	    suspended: true
+//
+// The openid field holds the email address of the user logged in by the
+// OpenID provider; if it is blank the first user is logged in. The
+// otp_seed field holds the base32 encoded seed of the user's time-based
+// one-time passwords, as shown by authenticator apps. Values that are
+// omitted, such as OpenID identifiers, secrets and token keys, are
+// generated.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+var addr = flag.String("addr", "localhost:0", "`address` to listen on")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: usso-fakeserver [-addr host:port] [fixture]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var f fixture
+	if flag.NArg() == 1 {
+		data, err := ioutil.ReadFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := f.parse(data); err != nil {
+			log.Fatalf("cannot parse %s: %v", flag.Arg(0), err)
+		}
+	}
+	h, err := newHandler(&f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("http://%s\n", l.Addr())
+	log.Fatal(http.Serve(l, h))
+}
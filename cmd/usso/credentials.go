@@ -0,0 +1,611 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/usso"
+)
+
+var credentialsCommands = []command{{
+	name:    "export",
+	args:    "[flags]",
+	summary: "write the stored credentials in a format for other tools",
+	run:     runCredentialsExport,
+}, {
+	name:    "import",
+	args:    "[flags] [file]",
+	summary: "store credentials written by export or by older clients",
+	run:     runCredentialsImport,
+}}
+
+// credentials holds credentials in the form they are exported and
+// imported.
+type credentials struct {
+	Server         string `json:"server,omitempty" yaml:"server,omitempty"`
+	Email          string `json:"email,omitempty" yaml:"email,omitempty"`
+	ConsumerKey    string `json:"consumer_key" yaml:"consumer_key"`
+	ConsumerSecret string `json:"consumer_secret" yaml:"consumer_secret"`
+	TokenKey       string `json:"token_key" yaml:"token_key"`
+	TokenSecret    string `json:"token_secret" yaml:"token_secret"`
+	TokenName      string `json:"token_name,omitempty" yaml:"token_name,omitempty"`
+	Realm          string `json:"realm,omitempty" yaml:"realm,omitempty"`
+
+	// profile holds the name of the exported profile. It is only
+	// used to name the kubernetes secret.
+	profile string
+}
+
+// credentialVar holds the name of an environment variable used in the
+// env and shell formats and the field of credentials it holds.
+type credentialVar struct {
+	name  string
+	field func(*credentials) *string
+}
+
+var credentialVars = []credentialVar{
+	{"USSO_SERVER", func(c *credentials) *string { return &c.Server }},
+	{"USSO_EMAIL", func(c *credentials) *string { return &c.Email }},
+	{"USSO_CONSUMER_KEY", func(c *credentials) *string { return &c.ConsumerKey }},
+	{"USSO_CONSUMER_SECRET", func(c *credentials) *string { return &c.ConsumerSecret }},
+	{"USSO_TOKEN_KEY", func(c *credentials) *string { return &c.TokenKey }},
+	{"USSO_TOKEN_SECRET", func(c *credentials) *string { return &c.TokenSecret }},
+	{"USSO_TOKEN_NAME", func(c *credentials) *string { return &c.TokenName }},
+	{"USSO_REALM", func(c *credentials) *string { return &c.Realm }},
+}
+
+// exportFormats holds the formats that credentials can be exported in.
+var exportFormats = map[string]func(*credentials) ([]byte, error){
+	"env":        formatEnv,
+	"json":       formatJSON,
+	"kubernetes": formatKubernetes,
+	"netrc":      formatNetrc,
+	"shell":      formatShell,
+	"yaml":       formatYAML,
+}
+
+// importFormats holds the formats that credentials can be imported
+// from. The ubuntuone format is the form encoded credentials stored in
+// the keyring by the Ubuntu One and Ubuntu SSO clients.
+var importFormats = map[string]func([]byte) (*credentials, error){
+	"env":        parseEnv,
+	"json":       parseJSON,
+	"kubernetes": parseKubernetes,
+	"netrc":      parseNetrc,
+	"shell":      parseShell,
+	"ubuntuone":  parseUbuntuOne,
+	"yaml":       parseYAML,
+}
+
+// runCredentialsExport runs the credentials export command.
+func runCredentialsExport(e *env, args []string) error {
+	fs := e.newFlagSet("credentials export")
+	profileName := e.profileFlag(fs)
+	format := fs.String("format", "json", "output `format`: env (for docker --env-file), json, yaml, shell, kubernetes (a Secret) or netrc")
+	showSecrets := fs.Bool("show-secrets", false, "print the credentials, including their secrets, to standard output")
+	output := fs.String("o", "", "write the credentials to `file`, which is only readable by its owner")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	formatter, ok := exportFormats[*format]
+	if !ok {
+		return usagef("unknown format %q", *format)
+	}
+	if *output == "" && !*showSecrets {
+		return usagef("refusing to print secrets; use -show-secrets or -o")
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p, err := store.profile(*profileName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data, err := formatter(&credentials{
+		Server:         p.Server,
+		Email:          p.Email,
+		ConsumerKey:    p.Credentials.ConsumerKey,
+		ConsumerSecret: p.Credentials.ConsumerSecret,
+		TokenKey:       p.Credentials.TokenKey,
+		TokenSecret:    p.Credentials.TokenSecret,
+		TokenName:      p.Credentials.TokenName,
+		Realm:          p.Credentials.Realm,
+		profile:        *profileName,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *output == "" {
+		_, err := e.stdout.Write(data)
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(writePrivateFile(*output, data))
+}
+
+// runCredentialsImport runs the credentials import command.
+func runCredentialsImport(e *env, args []string) error {
+	fs := e.newFlagSet("credentials import")
+	profileName := e.profileFlag(fs)
+	format := fs.String("format", "", "input `format`: env, json, yaml, shell, kubernetes, netrc or ubuntuone (default detected from the input)")
+	force := fs.Bool("force", false, "replace the credentials of an existing profile")
+	var sf serverFlags
+	sf.register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var data []byte
+	var err error
+	switch fs.NArg() {
+	case 0:
+		data, err = ioutil.ReadAll(e.stdin)
+	case 1:
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	default:
+		return usagef("too many arguments")
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *format == "" {
+		*format = detectFormat(data)
+	}
+	parse, ok := importFormats[*format]
+	if !ok {
+		return usagef("unknown format %q", *format)
+	}
+	creds, err := parse(data)
+	if err != nil {
+		return errgo.Notef(err, "cannot parse %s credentials", *format)
+	}
+	if err := creds.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	server := serverForURL(creds.Server)
+	if creds.Server == "" || sf.staging || sf.url != "" {
+		if server, err = sf.server(); err != nil {
+			return err
+		}
+	}
+	if creds.Realm == "" {
+		creds.Realm = "API"
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, ok := store.Profiles[*profileName]; ok && !*force {
+		return errgo.Newf("profile %q already exists; use -force to replace it", *profileName)
+	}
+	store.Profiles[*profileName] = &profile{
+		Server: server.LoginURL(),
+		Email:  creds.Email,
+		Credentials: &usso.SSOData{
+			ConsumerKey:    creds.ConsumerKey,
+			ConsumerSecret: creds.ConsumerSecret,
+			Realm:          creds.Realm,
+			TokenKey:       creds.TokenKey,
+			TokenName:      creds.TokenName,
+			TokenSecret:    creds.TokenSecret,
+		},
+	}
+	if err := e.saveStore(store); err != nil {
+		return errgo.Notef(err, "cannot save credentials")
+	}
+	fmt.Fprintf(e.stderr, "Imported token %q into profile %q.\n", creds.TokenName, *profileName)
+	return nil
+}
+
+// validate checks that the credentials can be used to sign requests.
+// The consumer secret may be blank, as it is for Launchpad tokens.
+func (c *credentials) validate() error {
+	var missing []string
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"consumer_key", c.ConsumerKey},
+		{"token_key", c.TokenKey},
+		{"token_secret", c.TokenSecret},
+	} {
+		if f.value == "" {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errgo.Newf("credentials have no %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// envLine matches a variable assignment in the env and shell formats.
+var envLine = regexp.MustCompile(`^(?:export[ \t]+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// detectFormat returns the format of the given credentials.
+func detectFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	var secret kubernetesSecret
+	if err := yaml.Unmarshal(data, &secret); err == nil && secret.Kind == "Secret" {
+		return "kubernetes"
+	}
+	if fields := strings.Fields(string(data)); len(fields) > 0 && (fields[0] == "machine" || fields[0] == "default") {
+		return "netrc"
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("{")):
+		return "json"
+	case !bytes.ContainsAny(data, "\n") && bytes.Contains(data, []byte("consumer_key=")) && bytes.Contains(data, []byte("&")):
+		return "ubuntuone"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := envLine.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if strings.HasPrefix(line, "export") || strings.HasPrefix(m[2], "'") || strings.HasPrefix(m[2], `"`) {
+			return "shell"
+		}
+		return "env"
+	}
+	return "yaml"
+}
+
+// formatEnv formats c as the assignments of an environment file, as
+// read by docker --env-file. Such files have no quoting, so the values
+// are written unchanged and may not contain newlines. Use the shell
+// format for files that are read by a shell.
+func formatEnv(c *credentials) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range credentialVars {
+		value := *v.field(c)
+		if value == "" {
+			continue
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errgo.Newf("cannot write %s in env format: value contains a newline", v.name)
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", v.name, value)
+	}
+	return buf.Bytes(), nil
+}
+
+// formatShell formats c as POSIX shell commands that export the
+// credentials as environment variables.
+func formatShell(c *credentials) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range credentialVars {
+		if value := *v.field(c); value != "" {
+			fmt.Fprintf(&buf, "export %s=%s\n", v.name, shellQuote(value))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// formatJSON formats c as a JSON object.
+func formatJSON(c *credentials) ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return append(data, '\n'), nil
+}
+
+// formatYAML formats c as a YAML mapping.
+func formatYAML(c *credentials) ([]byte, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return data, nil
+}
+
+// kubernetesSecret holds the parts of a Kubernetes Secret object that
+// hold credentials.
+type kubernetesSecret struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+}
+
+// formatKubernetes formats c as a Kubernetes Secret, suitable for
+// kubectl apply, that holds the same variables as the env format. The
+// secret is named after the exported profile.
+func formatKubernetes(c *credentials) ([]byte, error) {
+	var secret kubernetesSecret
+	secret.APIVersion = "v1"
+	secret.Kind = "Secret"
+	secret.Metadata.Name = kubernetesName(c.profile)
+	secret.Type = "Opaque"
+	secret.Data = make(map[string]string)
+	for _, v := range credentialVars {
+		if value := *v.field(c); value != "" {
+			secret.Data[v.name] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	data, err := yaml.Marshal(&secret)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return data, nil
+}
+
+// kubernetesName returns the name of the secret holding the
+// credentials of the given profile. Characters that are not allowed in
+// Kubernetes object names are replaced with hyphens.
+func kubernetesName(profileName string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, profileName)
+	name = strings.Trim(name, "-.")
+	if name == "" {
+		return "usso"
+	}
+	return "usso-" + name
+}
+
+// formatNetrc formats c as a .netrc entry for the host of the server.
+// The login is the email address of the account, or the consumer key if
+// that is not known, and the password holds the credentials in the
+// ubuntuone format. The realm is not included.
+func formatNetrc(c *credentials) ([]byte, error) {
+	host := "login.ubuntu.com"
+	if c.Server != "" {
+		u, err := url.Parse(c.Server)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid server")
+		}
+		if u.Scheme != "https" {
+			return nil, errgo.Newf("cannot write server %q in netrc format: only https servers are supported", c.Server)
+		}
+		host = u.Host
+	}
+	login := c.Email
+	if login == "" {
+		login = c.ConsumerKey
+	}
+	if strings.ContainsAny(login, " \t\r\n") {
+		return nil, errgo.Newf("cannot write login %q in netrc format: value contains white space", login)
+	}
+	password := url.Values{
+		"consumer_key":    {c.ConsumerKey},
+		"consumer_secret": {c.ConsumerSecret},
+		"name":            {c.TokenName},
+		"token":           {c.TokenKey},
+		"token_secret":    {c.TokenSecret},
+	}
+	return []byte(fmt.Sprintf("machine %s login %s password %s\n", host, login, password.Encode())), nil
+}
+
+// parseEnv parses credentials in the env format, in which values are
+// not quoted.
+func parseEnv(data []byte) (*credentials, error) {
+	return parseAssignments(data, func(s string) (string, error) {
+		return s, nil
+	})
+}
+
+// parseShell parses credentials in the shell format, in which values
+// may be quoted.
+func parseShell(data []byte) (*credentials, error) {
+	return parseAssignments(data, unquote)
+}
+
+// parseAssignments parses credentials from variable assignments, using
+// value to find the value of each assignment. Lines that do not assign
+// one of the credential variables are ignored.
+func parseAssignments(data []byte, value func(string) (string, error)) (*credentials, error) {
+	var c credentials
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := envLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, errgo.Newf("line %d: invalid assignment", i+1)
+		}
+		for _, v := range credentialVars {
+			if v.name != m[1] {
+				continue
+			}
+			s, err := value(m[2])
+			if err != nil {
+				return nil, errgo.Notef(err, "line %d", i+1)
+			}
+			*v.field(&c) = s
+		}
+	}
+	return &c, nil
+}
+
+// unquote removes the shell quoting from s, which holds a single word
+// that may contain single quoted, double quoted and backslash escaped
+// parts.
+func unquote(s string) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return "", errgo.New("unterminated single quote")
+			}
+			buf.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+		case '"':
+			for i++; ; i++ {
+				if i >= len(s) {
+					return "", errgo.New("unterminated double quote")
+				}
+				if s[i] == '"' {
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					if s[i] == 'n' {
+						buf.WriteByte('\n')
+						continue
+					}
+				}
+				buf.WriteByte(s[i])
+			}
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				buf.WriteByte(s[i])
+			}
+		case ' ', '\t':
+			return "", errgo.New("unexpected space in value")
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return buf.String(), nil
+}
+
+// parseJSON parses credentials in the JSON format. The output of
+// SSOData encoded as JSON is also accepted.
+func parseJSON(data []byte) (*credentials, error) {
+	var c credentials
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &c, nil
+}
+
+// parseYAML parses credentials in the YAML format.
+func parseYAML(data []byte) (*credentials, error) {
+	var c credentials
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &c, nil
+}
+
+// parseKubernetes parses credentials from a Kubernetes Secret in YAML
+// or JSON. Variables may be held in either the base64 encoded data or
+// in stringData.
+func parseKubernetes(data []byte) (*credentials, error) {
+	var secret kubernetesSecret
+	if err := yaml.Unmarshal(data, &secret); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if secret.Kind != "Secret" {
+		return nil, errgo.Newf("unexpected kind %q", secret.Kind)
+	}
+	var c credentials
+	for _, v := range credentialVars {
+		if s, ok := secret.StringData[v.name]; ok {
+			*v.field(&c) = s
+			continue
+		}
+		s, ok := secret.Data[v.name]
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid %s", v.name)
+		}
+		*v.field(&c) = string(b)
+	}
+	return &c, nil
+}
+
+// parseNetrc parses credentials from the first entry of a .netrc file
+// with a password in the ubuntuone format, as written by formatNetrc.
+// The server is taken from the machine name of the entry, and the login
+// is used as the email address when it looks like one.
+func parseNetrc(data []byte) (*credentials, error) {
+	var machine, login, password string
+	found := func() bool {
+		return strings.Contains(password, "consumer_key=")
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields) && !found(); i++ {
+		switch fields[i] {
+		case "machine", "default":
+			machine, login, password = "", "", ""
+			if fields[i] == "machine" && i+1 < len(fields) {
+				i++
+				machine = fields[i]
+			}
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				return nil, errgo.Newf("no value for %s", fields[i])
+			}
+			i++
+			switch fields[i-1] {
+			case "login":
+				login = fields[i]
+			case "password":
+				password = fields[i]
+			}
+		case "macdef":
+			return nil, errgo.New("macdef is not supported")
+		default:
+			return nil, errgo.Newf("unexpected %q", fields[i])
+		}
+	}
+	if !found() {
+		return nil, errgo.New("no entry holds usso credentials")
+	}
+	c, err := parseUbuntuOne([]byte(password))
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid password")
+	}
+	if machine != "" {
+		c.Server = "https://" + machine
+	}
+	if strings.Contains(login, "@") {
+		c.Email = login
+	}
+	return c, nil
+}
+
+// parseUbuntuOne parses the form encoded credentials stored by the
+// Ubuntu One and Ubuntu SSO clients, which name the token key "token"
+// and the token name "name".
+func parseUbuntuOne(data []byte) (*credentials, error) {
+	v, err := url.ParseQuery(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &credentials{
+		ConsumerKey:    v.Get("consumer_key"),
+		ConsumerSecret: v.Get("consumer_secret"),
+		TokenKey:       v.Get("token"),
+		TokenSecret:    v.Get("token_secret"),
+		TokenName:      v.Get("name"),
+	}, nil
+}
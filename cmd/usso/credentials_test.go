@@ -0,0 +1,383 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+)
+
+var testCredentials = &credentials{
+	Server:         "https://login.staging.ubuntu.com",
+	Email:          "foo@bar.com",
+	ConsumerKey:    "consumer-key",
+	ConsumerSecret: "consumer$ecret'\"",
+	TokenKey:       "token-key",
+	TokenSecret:    "token secret",
+	TokenName:      "my token",
+	Realm:          "API",
+}
+
+// storeCredentials stores testCredentials in the credential store of te
+// under the named profile.
+func (te *testEnv) storeCredentials(c *qt.C, profileName string) {
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	store.Profiles[profileName] = &profile{
+		Server: testCredentials.Server,
+		Email:  testCredentials.Email,
+		Credentials: &usso.SSOData{
+			ConsumerKey:    testCredentials.ConsumerKey,
+			ConsumerSecret: testCredentials.ConsumerSecret,
+			Realm:          testCredentials.Realm,
+			TokenKey:       testCredentials.TokenKey,
+			TokenName:      testCredentials.TokenName,
+			TokenSecret:    testCredentials.TokenSecret,
+		},
+	}
+	err = store.save(te.storePath)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	c := qt.New(t)
+
+	for format := range exportFormats {
+		c.Run(format, func(c *qt.C) {
+			te := newTestEnv(c, "")
+			te.storeCredentials(c, "default")
+			code := te.run("credentials", "export", "-format", format, "-show-secrets")
+			c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+			exported := te.stdout.String()
+			c.Assert(detectFormat([]byte(exported)), qt.Equals, map[string]string{
+				"env":        "env",
+				"json":       "json",
+				"kubernetes": "kubernetes",
+				"netrc":      "netrc",
+				"shell":      "shell",
+				"yaml":       "yaml",
+			}[format])
+
+			te.stdin.Reset(strings.NewReader(exported))
+			code = te.run("credentials", "import", "-profile", "copy")
+			c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+			c.Assert(te.stderr.String(), qt.Equals, "Imported token \"my token\" into profile \"copy\".\n")
+			store, err := loadStore(te.storePath)
+			c.Assert(err, qt.IsNil)
+			c.Assert(store.Profiles["copy"], qt.DeepEquals, store.Profiles["default"])
+		})
+	}
+}
+
+func TestExportShellEvaluates(t *testing.T) {
+	c := qt.New(t)
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		c.Skip("no shell available")
+	}
+	te := newTestEnv(c, "")
+	te.storeCredentials(c, "default")
+	code := te.run("credentials", "export", "-format", "shell", "-show-secrets")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	out, err := exec.Command("sh", "-c", te.stdout.String()+`printf '%s\n' "$USSO_CONSUMER_SECRET" "$USSO_TOKEN_SECRET"`).Output()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(out), qt.Equals, testCredentials.ConsumerSecret+"\n"+testCredentials.TokenSecret+"\n")
+}
+
+func TestExportRequiresExplicitFlag(t *testing.T) {
+	c := qt.New(t)
+
+	te := newTestEnv(c, "")
+	te.storeCredentials(c, "default")
+	code := te.run("credentials", "export")
+	c.Assert(code, qt.Equals, 2)
+	c.Assert(te.stdout.String(), qt.Equals, "")
+	c.Assert(te.stderr.String(), qt.Matches, "(?s)usso credentials export: refusing to print secrets; use -show-secrets or -o\n.*")
+
+	// An existing file is replaced by one only readable by its owner.
+	path := filepath.Join(c.Mkdir(), "creds.env")
+	err := ioutil.WriteFile(path, []byte("old"), 0644)
+	c.Assert(err, qt.IsNil)
+	code = te.run("credentials", "export", "-format", "env", "-o", path)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, "")
+	info, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0600))
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, `USSO_SERVER=https://login.staging.ubuntu.com
+USSO_EMAIL=foo@bar.com
+USSO_CONSUMER_KEY=consumer-key
+USSO_CONSUMER_SECRET=consumer$ecret'"
+USSO_TOKEN_KEY=token-key
+USSO_TOKEN_SECRET=token secret
+USSO_TOKEN_NAME=my token
+USSO_REALM=API
+`)
+}
+
+func TestExportKubernetes(t *testing.T) {
+	c := qt.New(t)
+
+	te := newTestEnv(c, "")
+	te.storeCredentials(c, "My_Profile")
+	code := te.run("credentials", "export", "-profile", "My_Profile", "-format", "kubernetes", "-show-secrets")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, `apiVersion: v1
+kind: Secret
+metadata:
+  name: usso-my-profile
+type: Opaque
+data:
+  USSO_CONSUMER_KEY: Y29uc3VtZXIta2V5
+  USSO_CONSUMER_SECRET: Y29uc3VtZXIkZWNyZXQnIg==
+  USSO_EMAIL: Zm9vQGJhci5jb20=
+  USSO_REALM: QVBJ
+  USSO_SERVER: aHR0cHM6Ly9sb2dpbi5zdGFnaW5nLnVidW50dS5jb20=
+  USSO_TOKEN_KEY: dG9rZW4ta2V5
+  USSO_TOKEN_NAME: bXkgdG9rZW4=
+  USSO_TOKEN_SECRET: dG9rZW4gc2VjcmV0
+`)
+}
+
+func TestExportNetrc(t *testing.T) {
+	c := qt.New(t)
+
+	te := newTestEnv(c, "")
+	te.storeCredentials(c, "default")
+	code := te.run("credentials", "export", "-format", "netrc", "-show-secrets")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, "machine login.staging.ubuntu.com login foo@bar.com password consumer_key=consumer-key&consumer_secret=consumer%24ecret%27%22&name=my+token&token=token-key&token_secret=token+secret\n")
+
+	_, err := formatNetrc(&credentials{
+		Server:      "http://localhost:8080",
+		ConsumerKey: "ck",
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot write server "http://localhost:8080" in netrc format: only https servers are supported`)
+}
+
+func TestExportEnvNewline(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := formatEnv(&credentials{
+		ConsumerKey: "ck",
+		TokenName:   "my\ntoken",
+	})
+	c.Assert(err, qt.ErrorMatches, "cannot write USSO_TOKEN_NAME in env format: value contains a newline")
+}
+
+var importTests = []struct {
+	about        string
+	args         []string
+	input        string
+	expectServer string
+	expect       usso.SSOData
+}{{
+	about: "ubuntuone keyring",
+	input: "consumer_key=ck&consumer_secret=cs&name=Ubuntu+One+%40+host&token=tk&token_secret=ts\n",
+	expect: usso.SSOData{
+		ConsumerKey:    "ck",
+		ConsumerSecret: "cs",
+		Realm:          "API",
+		TokenKey:       "tk",
+		TokenName:      "Ubuntu One @ host",
+		TokenSecret:    "ts",
+	},
+	expectServer: "https://login.ubuntu.com",
+}, {
+	about: "SSOData as JSON",
+	args:  []string{"-staging"},
+	input: `{"consumer_key": "ck", "consumer_secret": "cs", "realm": "API", "token_key": "tk", "token_name": "tn", "token_secret": "ts"}`,
+	expect: usso.SSOData{
+		ConsumerKey:    "ck",
+		ConsumerSecret: "cs",
+		Realm:          "API",
+		TokenKey:       "tk",
+		TokenName:      "tn",
+		TokenSecret:    "ts",
+	},
+	expectServer: "https://login.staging.ubuntu.com",
+}, {
+	about: "shell with comments and other variables",
+	args:  []string{"-server", "http://localhost:8080/"},
+	input: `# credentials
+export PATH=/bin
+export USSO_CONSUMER_KEY=ck
+USSO_TOKEN_KEY='tk'
+USSO_TOKEN_SECRET="t\"s"
+`,
+	expect: usso.SSOData{
+		ConsumerKey: "ck",
+		Realm:       "API",
+		TokenKey:    "tk",
+		TokenSecret: `t"s`,
+	},
+	expectServer: "http://localhost:8080",
+}, {
+	about: "env file values are not unquoted",
+	args:  []string{"-format", "env"},
+	input: `USSO_CONSUMER_KEY=ck
+USSO_TOKEN_KEY=tk
+USSO_TOKEN_SECRET="t s"
+`,
+	expect: usso.SSOData{
+		ConsumerKey: "ck",
+		Realm:       "API",
+		TokenKey:    "tk",
+		TokenSecret: `"t s"`,
+	},
+	expectServer: "https://login.ubuntu.com",
+}, {
+	about: "kubernetes secret with stringData",
+	input: `apiVersion: v1
+kind: Secret
+metadata:
+  name: sso
+stringData:
+  USSO_CONSUMER_KEY: ck
+  USSO_TOKEN_KEY: tk
+data:
+  USSO_TOKEN_KEY: aWdub3JlZA==
+  USSO_TOKEN_SECRET: dHM=
+`,
+	expect: usso.SSOData{
+		ConsumerKey: "ck",
+		Realm:       "API",
+		TokenKey:    "tk",
+		TokenSecret: "ts",
+	},
+	expectServer: "https://login.ubuntu.com",
+}, {
+	about: "kubernetes secret as JSON",
+	input: `{"apiVersion": "v1", "kind": "Secret", "data": {"USSO_SERVER": "aHR0cHM6Ly9sb2dpbi5zdGFnaW5nLnVidW50dS5jb20=", "USSO_CONSUMER_KEY": "Y2s=", "USSO_TOKEN_KEY": "dGs=", "USSO_TOKEN_SECRET": "dHM="}}`,
+	expect: usso.SSOData{
+		ConsumerKey: "ck",
+		Realm:       "API",
+		TokenKey:    "tk",
+		TokenSecret: "ts",
+	},
+	expectServer: "https://login.staging.ubuntu.com",
+}, {
+	about: "netrc with other entries",
+	input: `machine example.com login bob password secret
+machine login.staging.ubuntu.com
+	login ck
+	password consumer_key=ck&consumer_secret=cs&name=tn&token=tk&token_secret=ts
+default login anonymous password me@example.com
+`,
+	expect: usso.SSOData{
+		ConsumerKey:    "ck",
+		ConsumerSecret: "cs",
+		Realm:          "API",
+		TokenKey:       "tk",
+		TokenName:      "tn",
+		TokenSecret:    "ts",
+	},
+	expectServer: "https://login.staging.ubuntu.com",
+}}
+
+func TestImport(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range importTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, test.input)
+			code := te.run(append([]string{"credentials", "import"}, test.args...)...)
+			c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+			store, err := loadStore(te.storePath)
+			c.Assert(err, qt.IsNil)
+			p, err := store.profile("default")
+			c.Assert(err, qt.IsNil)
+			c.Assert(p.Server, qt.Equals, test.expectServer)
+			c.Assert(*p.Credentials, qt.Equals, test.expect)
+		})
+	}
+}
+
+var importErrorTests = []struct {
+	about       string
+	args        []string
+	input       string
+	expectCode  int
+	expectError string
+}{{
+	about:       "missing fields",
+	input:       "consumer_key: ck\n",
+	expectCode:  1,
+	expectError: "usso credentials import: credentials have no token_key, token_secret\n",
+}, {
+	about:       "bad json",
+	input:       "{",
+	expectCode:  1,
+	expectError: "usso credentials import: cannot parse json credentials: unexpected end of JSON input\n",
+}, {
+	about:       "bad quoting",
+	args:        []string{"-format", "shell"},
+	input:       "USSO_TOKEN_KEY='tk\n",
+	expectCode:  1,
+	expectError: "usso credentials import: cannot parse shell credentials: line 1: unterminated single quote\n",
+}, {
+	about:       "kubernetes object that is not a secret",
+	args:        []string{"-format", "kubernetes"},
+	input:       "apiVersion: v1\nkind: ConfigMap\n",
+	expectCode:  1,
+	expectError: "usso credentials import: cannot parse kubernetes credentials: unexpected kind \"ConfigMap\"\n",
+}, {
+	about:       "bad kubernetes data",
+	input:       "kind: Secret\ndata:\n  USSO_TOKEN_KEY: '!'\n",
+	expectCode:  1,
+	expectError: "usso credentials import: cannot parse kubernetes credentials: invalid USSO_TOKEN_KEY: illegal base64 data at input byte 0\n",
+}, {
+	about:       "netrc without credentials",
+	input:       "machine example.com login bob password secret\n",
+	expectCode:  1,
+	expectError: "usso credentials import: cannot parse netrc credentials: no entry holds usso credentials\n",
+}, {
+	about:       "unknown format",
+	args:        []string{"-format", "xml"},
+	expectCode:  2,
+	expectError: "usso credentials import: unknown format \"xml\"\n.*",
+}}
+
+func TestImportErrors(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range importErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, test.input)
+			c.Assert(te.run(append([]string{"credentials", "import"}, test.args...)...), qt.Equals, test.expectCode)
+			c.Assert(te.stderr.String(), qt.Matches, "(?s)"+test.expectError)
+		})
+	}
+}
+
+func TestImportExistingProfile(t *testing.T) {
+	c := qt.New(t)
+
+	te := newTestEnv(c, "")
+	te.storeCredentials(c, "default")
+	input := "consumer_key=ck&consumer_secret=cs&name=n&token=tk&token_secret=ts"
+	te.stdin.Reset(strings.NewReader(input))
+	code := te.run("credentials", "import")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Equals, "usso credentials import: profile \"default\" already exists; use -force to replace it\n")
+
+	path := filepath.Join(c.Mkdir(), "credentials")
+	err := ioutil.WriteFile(path, []byte(input), 0600)
+	c.Assert(err, qt.IsNil)
+	code = te.run("credentials", "import", "-force", path)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.Profiles["default"].Credentials.TokenKey, qt.Equals, "tk")
+}
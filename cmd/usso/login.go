@@ -0,0 +1,148 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// serverFlags holds the flags that select the Ubuntu SSO server.
+type serverFlags struct {
+	staging bool
+	url     string
+}
+
+// register registers the flags on fs.
+func (f *serverFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.staging, "staging", false, "use the staging Ubuntu SSO server")
+	fs.StringVar(&f.url, "server", "", "base `URL` of the Ubuntu SSO server (default https://login.ubuntu.com)")
+}
+
+// server returns the server selected by the flags.
+func (f *serverFlags) server() (usso.UbuntuSSOServer, error) {
+	switch {
+	case f.staging && f.url != "":
+		return usso.UbuntuSSOServer{}, usagef("cannot use both -staging and -server")
+	case f.staging:
+		return usso.StagingUbuntuSSOServer, nil
+	case f.url != "":
+		return serverForURL(f.url), nil
+	}
+	return usso.ProductionUbuntuSSOServer, nil
+}
+
+// defaultTokenName returns the name given to new tokens when the
+// -token-name flag is not used.
+func defaultTokenName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "usso"
+	}
+	return "usso@" + host
+}
+
+// runLogin runs the login command.
+func runLogin(e *env, args []string) error {
+	fs := e.newFlagSet("login")
+	profileName := e.profileFlag(fs)
+	var sf serverFlags
+	sf.register(fs)
+	email := fs.String("email", "", "`address` of the account (prompted for if not given)")
+	tokenName := fs.String("token-name", defaultTokenName(), "`name` of the new token")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	server, err := sf.server()
+	if err != nil {
+		return err
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *email == "" {
+		if *email, err = e.prompt("Email: "); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	password, err := e.readPassword("Password: ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ctx := context.Background()
+	ssodata, err := server.GetTokenWithOTPContext(ctx, *email, password, "", *tokenName)
+	if uerr, ok := err.(*usso.Error); ok && uerr.Code == usso.CodeTwoFactorRequired {
+		otp, err1 := e.prompt("One-time password: ")
+		if err1 != nil {
+			return errgo.Mask(err1)
+		}
+		ssodata, err = server.GetTokenWithOTPContext(ctx, *email, password, otp, *tokenName)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot log in")
+	}
+	store.Profiles[*profileName] = &profile{
+		Server:      server.LoginURL(),
+		Email:       *email,
+		Credentials: ssodata,
+	}
+	if err := e.saveStore(store); err != nil {
+		return errgo.Notef(err, "cannot save credentials")
+	}
+	fmt.Fprintf(e.stderr, "Logged in as %s; token %q stored in profile %q.\n", *email, ssodata.TokenName, *profileName)
+	return nil
+}
+
+// runLogout runs the logout command.
+func runLogout(e *env, args []string) error {
+	fs := e.newFlagSet("logout")
+	profileName := e.profileFlag(fs)
+	keep := fs.Bool("keep-token", false, "delete the stored credentials without revoking the token")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p, err := store.profile(*profileName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !*keep {
+		err := p.server().RevokeToken(context.Background(), p.Credentials, p.Credentials.TokenKey)
+		if err != nil && !isTokenGone(err) {
+			return errgo.Notef(err, "cannot revoke token (use -keep-token to delete the credentials anyway)")
+		}
+	}
+	delete(store.Profiles, *profileName)
+	if err := e.saveStore(store); err != nil {
+		return errgo.Notef(err, "cannot save credentials")
+	}
+	fmt.Fprintf(e.stderr, "Logged out of profile %q.\n", *profileName)
+	return nil
+}
+
+// isTokenGone reports whether err shows that the token used to make a
+// request no longer exists, so there is nothing left to revoke.
+func isTokenGone(err error) bool {
+	uerr, ok := err.(*usso.Error)
+	if !ok {
+		return false
+	}
+	return uerr.Code == usso.CodeResourceNotFound || uerr.Code == usso.CodeInvalidCredentials
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso/ussotest"
+)
+
+const (
+	email    = "foo@bar.com"
+	password = "foobarpwd"
+)
+
+// testEnv holds an environment for running commands in tests.
+type testEnv struct {
+	*env
+	stdout, stderr bytes.Buffer
+	passwords      []string
+}
+
+// newTestEnv returns an environment with its credential store in a
+// temporary directory. Lines read from standard input are taken from
+// input.
+func newTestEnv(c *qt.C, input string) *testEnv {
+	te := &testEnv{}
+	te.env = &env{
+		stdin:     bufio.NewReader(strings.NewReader(input)),
+		stdout:    &te.stdout,
+		stderr:    &te.stderr,
+		storePath: filepath.Join(c.Mkdir(), "usso", "credentials.json"),
+		readPassword: func(prompt string) (string, error) {
+			c.Assert(te.passwords, qt.Not(qt.HasLen), 0, qt.Commentf("unexpected password prompt"))
+			p := te.passwords[0]
+			te.passwords = te.passwords[1:]
+			return p, nil
+		},
+	}
+	return te
+}
+
+// run runs the usso command with the given arguments and returns its
+// exit status.
+func (te *testEnv) run(args ...string) int {
+	te.stdout.Reset()
+	te.stderr.Reset()
+	return run(te.env, args)
+}
+
+func TestLoginLogout(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, email+"\n")
+	te.passwords = []string{password}
+	code := te.run("login", "-server", srv.URL, "-token-name", "my-token")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stderr.String(), qt.Equals, "Email: Logged in as foo@bar.com; token \"my-token\" stored in profile \"default\".\n")
+	c.Assert(srv.Tokens(email), qt.HasLen, 1)
+
+	info, err := os.Stat(te.storePath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0600))
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	p, err := store.profile("default")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Server, qt.Equals, srv.URL)
+	c.Assert(p.Email, qt.Equals, email)
+	c.Assert(p.Credentials.TokenKey, qt.Equals, srv.Tokens(email)[0].TokenKey)
+	valid, err := p.server().IsTokenValid(p.Credentials)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+
+	code = te.run("logout")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(srv.Tokens(email), qt.HasLen, 0)
+	store, err = loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.Profiles, qt.HasLen, 0)
+
+	code = te.run("logout")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Equals, "usso logout: no credentials for profile \"default\"; run \"usso login\" first\n")
+}
+
+func TestLoginOTP(t *testing.T) {
+	c := qt.New(t)
+
+	seed := []byte("12345678901234567890")
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password, OTPSeed: seed})
+	te := newTestEnv(c, ussotest.TOTP(seed, time.Now())+"\n")
+	te.passwords = []string{password}
+	code := te.run("login", "-server", srv.URL, "-email", email, "-profile", "work")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stderr.String(), qt.Matches, "One-time password: Logged in as foo@bar.com; token \"usso.*\" stored in profile \"work\".\n")
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	_, err = store.profile("work")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestLoginError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	te.passwords = []string{"wrong"}
+	code := te.run("login", "-server", srv.URL, "-email", email)
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Equals, "usso login: cannot log in: Provided email/password is not correct.\n")
+	_, err := os.Stat(te.storePath)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestLogoutKeepsCredentialsOnError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	te.passwords = []string{password}
+	code := te.run("login", "-server", srv.URL, "-email", email)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	srv.AddFault(ussotest.ServiceUnavailable("DELETE", "", 1, ""))
+	code = te.run("logout")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Matches, "usso logout: cannot revoke token \\(use -keep-token to delete the credentials anyway\\): .*\n")
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.Profiles, qt.HasLen, 1)
+
+	// A token that has already been revoked is not an error.
+	p := store.Profiles["default"]
+	err = p.server().RevokeToken(context.Background(), p.Credentials, p.Credentials.TokenKey)
+	c.Assert(err, qt.IsNil)
+	code = te.run("logout")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	store, err = loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.Profiles, qt.HasLen, 0)
+}
+
+var usageTests = []struct {
+	about       string
+	args        []string
+	expectCode  int
+	expectError string
+}{{
+	about:       "no command",
+	expectCode:  2,
+	expectError: "usage: usso <command> .*",
+}, {
+	about:       "unknown command",
+	args:        []string{"frobnicate"},
+	expectCode:  2,
+	expectError: "usso: unknown command \"frobnicate\"\n.*",
+}, {
+	about:       "unknown flag",
+	args:        []string{"login", "-foo"},
+	expectCode:  2,
+	expectError: "flag provided but not defined: -foo\nusage: usso login .*",
+}, {
+	about:       "extra arguments",
+	args:        []string{"logout", "foo"},
+	expectCode:  2,
+	expectError: "usso logout: unexpected arguments \\[\"foo\"\\]\nusage: usso logout \\[flags\\]\n",
+}, {
+	about:       "conflicting servers",
+	args:        []string{"login", "-staging", "-server", "http://0.1.2.3"},
+	expectCode:  2,
+	expectError: "usso login: cannot use both -staging and -server\n.*",
+}}
+
+func TestUsage(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range usageTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, "")
+			c.Assert(te.run(test.args...), qt.Equals, test.expectCode)
+			c.Assert(te.stderr.String(), qt.Matches, "(?s)"+test.expectError)
+		})
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+// The usso command obtains Ubuntu SSO credentials and uses them from the
+// command line.
+//
+// Usage:
+//
+//	usso <command> [flags] [args]
+//
+// The commands are:
+//
+//	login        obtain a token and store it under a profile
+//	logout       revoke the token of a profile and delete it
+//	sign         sign a request and print its OAuth parameters
+//	request      sign and send a request
+//	token        inspect and manage tokens
+//	credentials  export and import stored credentials
+//	proxy        run a local proxy that signs requests
+//
+// Run "usso help <command>" for the flags of each command.
+//
+// The sign and request commands sign the request given by their method
+// and URL arguments, and their -H and -d flags, with stored credentials.
+// The method defaults to GET, or POST when there is a body. A body
+// without a Content-Type header is sent as application/json if it is
+// valid JSON and as a form otherwise.
+//
+// The token commands print tables by default and JSON when given the
+// -json flag. They exit with status 3 when the server rejects the stored
+// token, and with status 1 on other errors, such as failing to reach the
+// server. Usage errors exit with status 2.
+//
+// The credentials export command writes a profile's credentials as
+// JSON, YAML, an environment file, or shell commands that set the
+// USSO_CONSUMER_KEY, USSO_CONSUMER_SECRET, USSO_TOKEN_KEY and
+// USSO_TOKEN_SECRET variables and their companions. As the output holds
+// the secrets, it is only printed when the -show-secrets flag is given;
+// otherwise the -o flag must name a file to write. The credentials
+// import command reads any of these formats, and the form encoded
+// credentials stored by the Ubuntu One and Ubuntu SSO clients.
+//
+// The proxy command runs an HTTP proxy for programs that cannot sign
+// requests themselves. Given the -upstream flag it forwards every
+// request to that server; otherwise it is a forward proxy for clients
+// that use the HTTP_PROXY environment variable. Requests are only signed
+// when they are sent to the upstream server or to a host given with the
+// -allow flag. Each request is logged to standard error, showing whether
+// it was signed. The proxy does not authenticate its clients, so anyone
+// that can connect to it can make requests with the stored credentials;
+// it listens on localhost:8080 by default and refuses to listen on an
+// address other machines can reach unless the -allow-remote flag is
+// given.
+//
+// Credentials are stored in the file named by the USSO_CREDENTIALS
+// environment variable or, if that is not set, in usso/credentials.json
+// in the user's configuration directory. The file is only readable by
+// its owner. Commands use the profile named by the -profile flag, or the
+// USSO_PROFILE environment variable, or "default".
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/errgo.v1"
+)
+
+// command holds a subcommand of usso.
+type command struct {
+	// name holds the name of the command.
+	name string
+
+	// args describes the arguments of the command in its usage
+	// message.
+	args string
+
+	// summary holds a one line description of the command.
+	summary string
+
+	// run runs the command with the given arguments, which do not
+	// include the command name.
+	run func(e *env, args []string) error
+
+	// commands holds the subcommands of the command, if it has
+	// them instead of a run function.
+	commands []command
+}
+
+var commands []command
+
+func init() {
+	commands = []command{{
+		name:    "login",
+		args:    "[flags]",
+		summary: "obtain a token and store it under a profile",
+		run:     runLogin,
+	}, {
+		name:    "logout",
+		args:    "[flags]",
+		summary: "revoke the token of a profile and delete it",
+		run:     runLogout,
+	}, {
+		name:    "sign",
+		args:    "[flags] [method] url",
+		summary: "sign a request and print its OAuth parameters",
+		run:     runSign,
+	}, {
+		name:    "request",
+		args:    "[flags] [method] url",
+		summary: "sign and send a request",
+		run:     runRequest,
+	}, {
+		name:     "token",
+		summary:  "inspect and manage tokens",
+		commands: tokenCommands,
+	}, {
+		name:     "credentials",
+		summary:  "export and import stored credentials",
+		commands: credentialsCommands,
+	}, {
+		name:    "proxy",
+		args:    "[flags]",
+		summary: "run a local proxy that signs requests",
+		run:     runProxy,
+	}, {
+		name:    "help",
+		args:    "[command]",
+		summary: "show help for a command",
+		run:     runHelp,
+	}}
+}
+
+// env holds the environment a command runs in.
+type env struct {
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// storePath holds the path of the credential store.
+	storePath string
+
+	// defaultProfile holds the profile used when no -profile flag is
+	// given.
+	defaultProfile string
+
+	// readPassword reads a password from the user without echoing
+	// it.
+	readPassword func(prompt string) (string, error)
+}
+
+func main() {
+	e := &env{
+		stdin:          bufio.NewReader(os.Stdin),
+		stdout:         os.Stdout,
+		stderr:         os.Stderr,
+		storePath:      os.Getenv("USSO_CREDENTIALS"),
+		defaultProfile: os.Getenv("USSO_PROFILE"),
+	}
+	e.readPassword = e.readTerminalPassword
+	os.Exit(run(e, os.Args[1:]))
+}
+
+// usageError is returned by commands when they are invoked with invalid
+// arguments.
+type usageError struct {
+	msg string
+}
+
+func (err *usageError) Error() string {
+	return err.msg
+}
+
+// usagef returns a *usageError with the given message.
+func usagef(format string, a ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, a...)}
+}
+
+// exitError is returned by commands that exit with a status other than
+// 1 to report a result, such as an invalid token. If err is nil then no
+// message is printed.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (err *exitError) Error() string {
+	if err.err == nil {
+		return fmt.Sprintf("exit status %d", err.code)
+	}
+	return err.err.Error()
+}
+
+// run runs the command named by args[0] and returns the exit status.
+func run(e *env, args []string) int {
+	return runCommand(e, "usso", commands, args)
+}
+
+// runCommand runs the command in cmds named by args[0] and returns the
+// exit status. The prefix holds the names of the parent commands.
+func runCommand(e *env, prefix string, cmds []command, args []string) int {
+	if len(args) == 0 {
+		printUsage(e.stderr, prefix, cmds)
+		return 2
+	}
+	cmd := lookupCommand(cmds, args[0])
+	if cmd == nil {
+		fmt.Fprintf(e.stderr, "%s: unknown command %q\n", prefix, args[0])
+		printUsage(e.stderr, prefix, cmds)
+		return 2
+	}
+	name := prefix + " " + cmd.name
+	if cmd.commands != nil {
+		return runCommand(e, name, cmd.commands, args[1:])
+	}
+	err := cmd.run(e, args[1:])
+	if err == nil {
+		return 0
+	}
+	if err == flag.ErrHelp {
+		return 2
+	}
+	switch cause := errgo.Cause(err).(type) {
+	case *usageError:
+		fmt.Fprintf(e.stderr, "%s: %s\n", name, cause.msg)
+		fmt.Fprintf(e.stderr, "usage: %s %s\n", name, cmd.args)
+		return 2
+	case *exitError:
+		if cause.err != nil {
+			fmt.Fprintf(e.stderr, "%s: %v\n", name, cause.err)
+		}
+		return cause.code
+	}
+	fmt.Fprintf(e.stderr, "%s: %v\n", name, err)
+	return 1
+}
+
+// lookupCommand returns the command in cmds with the given name, or nil
+// if there is none.
+func lookupCommand(cmds []command, name string) *command {
+	for i := range cmds {
+		if cmds[i].name == name {
+			return &cmds[i]
+		}
+	}
+	return nil
+}
+
+// findCommand returns the command with the given path of names, such
+// as "token list", or nil if there is none.
+func findCommand(path string) *command {
+	var cmd *command
+	cmds := commands
+	for _, name := range strings.Fields(path) {
+		if cmd = lookupCommand(cmds, name); cmd == nil {
+			return nil
+		}
+		cmds = cmd.commands
+	}
+	return cmd
+}
+
+// printUsage prints the list of commands in cmds to w. The prefix holds
+// the names of the parent commands.
+func printUsage(w io.Writer, prefix string, cmds []command) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\nThe commands are:\n\n", prefix)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "\t%-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun \"usso help %s<command>\" for the flags of each command.\n", strings.TrimPrefix(prefix+" ", "usso "))
+}
+
+// runHelp runs the help command.
+func runHelp(e *env, args []string) error {
+	if len(args) == 0 {
+		printUsage(e.stdout, "usso", commands)
+		return nil
+	}
+	path := strings.Join(args, " ")
+	cmd := findCommand(path)
+	if cmd == nil || cmd.name == "help" {
+		return usagef("unknown command %q", path)
+	}
+	if cmd.commands != nil {
+		printUsage(e.stdout, "usso "+path, cmd.commands)
+		return nil
+	}
+	if err := cmd.run(e, []string{"-h"}); err != flag.ErrHelp {
+		return err
+	}
+	return nil
+}
+
+// newFlagSet returns a flag set for the command with the given path,
+// as passed to findCommand, that writes its errors and usage message to
+// e.stderr.
+func (e *env) newFlagSet(path string) *flag.FlagSet {
+	cmd := findCommand(path)
+	fs := flag.NewFlagSet("usso "+path, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: usso %s %s\n\n%s.\n\n", path, cmd.args, strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args with fs. The flag package prints parse errors
+// and the usage message itself, so any error is reported as
+// flag.ErrHelp, which run treats as a usage error that has already been
+// printed.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	return nil
+}
+
+// noArgs returns a usage error if any arguments remain after parsing
+// the flags in fs.
+func noArgs(fs *flag.FlagSet) error {
+	if fs.NArg() > 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	return nil
+}
+
+// prompt prints the prompt to e.stderr and reads a line from e.stdin.
+func (e *env) prompt(prompt string) (string, error) {
+	fmt.Fprint(e.stderr, prompt)
+	line, err := e.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", errgo.Newf("unexpected end of input")
+		}
+		return "", errgo.Mask(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readTerminalPassword reads a password from the terminal without
+// echoing it. If standard input is not a terminal, the password is read
+// as a line of input.
+func (e *env) readTerminalPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return e.prompt(prompt)
+	}
+	fmt.Fprint(e.stderr, prompt)
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(e.stderr)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return string(password), nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// hostFlags implements flag.Value for a repeated host flag.
+type hostFlags []string
+
+func (h *hostFlags) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *hostFlags) Set(s string) error {
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			*h = append(*h, host)
+		}
+	}
+	return nil
+}
+
+// runProxy runs the proxy command.
+func runProxy(e *env, args []string) error {
+	sp, addr, err := newProxy(e, args)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	fmt.Fprintf(e.stdout, "http://%s\n", l.Addr())
+	return errgo.Mask(http.Serve(l, sp))
+}
+
+// newProxy returns the proxy described by the proxy command's arguments
+// and the address it should listen on.
+func newProxy(e *env, args []string) (*usso.SigningProxy, string, error) {
+	fs := e.newFlagSet("proxy")
+	profileName := e.profileFlag(fs)
+	addr := fs.String("addr", "localhost:8080", "`address` to listen on")
+	allowRemote := fs.Bool("allow-remote", false, "allow -addr to accept connections from other machines, which can then send requests signed with the credentials")
+	upstream := fs.String("upstream", "", "forward all requests to the server at `URL`, instead of acting as a forward proxy")
+	var allowed hostFlags
+	fs.Var(&allowed, "allow", "sign requests to `hosts`, a comma separated list; may be repeated")
+	forwardUnlisted := fs.Bool("forward-unlisted", false, "forward requests to hosts that are not allowed without signing them, instead of refusing them")
+	method := fs.String("signature-method", "HMAC-SHA1", "signature `method`, HMAC-SHA1 or PLAINTEXT (only for an https upstream)")
+	strict := fs.Bool("strict", false, "sign in strict conformance with RFC 5849")
+	quiet := fs.Bool("quiet", false, "do not log requests")
+	if err := parseFlags(fs, args); err != nil {
+		return nil, "", err
+	}
+	if err := noArgs(fs); err != nil {
+		return nil, "", err
+	}
+	// The proxy does not authenticate its clients, so anyone that
+	// can connect to it can act with the credentials.
+	if !*allowRemote && !isLoopback(*addr) {
+		return nil, "", usagef("refusing to listen on %q, which is not a loopback address; use -allow-remote to allow it", *addr)
+	}
+	sp := &usso.SigningProxy{
+		AllowedHosts:    allowed,
+		ForwardUnlisted: *forwardUnlisted,
+		Strict:          *strict,
+	}
+	switch strings.ToUpper(*method) {
+	case "HMAC-SHA1":
+		sp.SignatureMethod = usso.HMACSHA1{}
+	case "PLAINTEXT":
+		sp.SignatureMethod = usso.PLAINTEXT{}
+	default:
+		return nil, "", usagef("unknown signature method %q", *method)
+	}
+	if *upstream != "" {
+		u, err := url.Parse(*upstream)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, "", usagef("invalid upstream URL %q", *upstream)
+		}
+		sp.Upstream = u
+	} else if len(allowed) == 0 {
+		return nil, "", usagef("a forward proxy needs at least one -allow host")
+	}
+	if _, ok := sp.SignatureMethod.(usso.PLAINTEXT); ok && (sp.Upstream == nil || sp.Upstream.Scheme != "https") {
+		return nil, "", usagef("PLAINTEXT signatures can only be sent to an https upstream")
+	}
+	if !*quiet {
+		sp.Log = func(entry *usso.ProxyLogEntry) {
+			logProxyEntry(e, entry)
+		}
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	p, err := store.profile(*profileName)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	sp.SSOData = p.Credentials
+	return sp, *addr, nil
+}
+
+// isLoopback reports whether the listen address addr only accepts
+// connections from the local machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// logProxyEntry writes an access log line for entry to e.stderr.
+func logProxyEntry(e *env, entry *usso.ProxyLogEntry) {
+	signed := "unsigned"
+	if entry.Signed {
+		signed = "signed"
+	}
+	line := fmt.Sprintf("%s %s %s %d %s %s", time.Now().Format("2006/01/02 15:04:05"), entry.Method, entry.URL, entry.StatusCode, signed, entry.Duration.Round(time.Millisecond))
+	if entry.Err != nil {
+		line += ": " + entry.Err.Error()
+	}
+	fmt.Fprintln(e.stderr, line)
+}
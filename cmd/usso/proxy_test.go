@@ -0,0 +1,122 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+)
+
+func TestProxy(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "default")
+	sp, addr, err := newProxy(te.env, []string{"-upstream", srv.URL, "-addr", "localhost:0"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, "localhost:0")
+	proxy := httptest.NewServer(sp)
+
+	resp, err := http.Get(proxy.URL + "/api/v2/tokens/oauth/" + ssodata.TokenKey)
+	c.Assert(err, qt.IsNil)
+	var details usso.TokenDetails
+	err = json.NewDecoder(resp.Body).Decode(&details)
+	resp.Body.Close()
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(details.TokenKey, qt.Equals, ssodata.TokenKey)
+
+	// Close waits for the request to be logged.
+	proxy.Close()
+	c.Assert(te.stderr.String(), qt.Matches, `\d{4}/\d\d/\d\d \d\d:\d\d:\d\d GET `+srv.URL+`/api/v2/tokens/oauth/`+ssodata.TokenKey+` 200 signed \d+m?s\n`)
+}
+
+var proxyUsageTests = []struct {
+	about       string
+	args        []string
+	expectError string
+}{{
+	about:       "forward proxy without allowed hosts",
+	args:        []string{"proxy"},
+	expectError: "usso proxy: a forward proxy needs at least one -allow host\n.*",
+}, {
+	about:       "invalid upstream",
+	args:        []string{"proxy", "-upstream", "/relative"},
+	expectError: "usso proxy: invalid upstream URL \"/relative\"\n.*",
+}, {
+	about:       "bad signature method",
+	args:        []string{"proxy", "-allow", "example.com", "-signature-method", "RSA-SHA1"},
+	expectError: "usso proxy: unknown signature method \"RSA-SHA1\"\n.*",
+}, {
+	about:       "plaintext forward proxy",
+	args:        []string{"proxy", "-allow", "example.com", "-signature-method", "PLAINTEXT"},
+	expectError: "usso proxy: PLAINTEXT signatures can only be sent to an https upstream\n.*",
+}, {
+	about:       "plaintext http upstream",
+	args:        []string{"proxy", "-upstream", "http://example.com", "-signature-method", "PLAINTEXT"},
+	expectError: "usso proxy: PLAINTEXT signatures can only be sent to an https upstream\n.*",
+}, {
+	about:       "all interfaces",
+	args:        []string{"proxy", "-upstream", "http://example.com", "-addr", ":8080"},
+	expectError: "usso proxy: refusing to listen on \":8080\", which is not a loopback address; use -allow-remote to allow it\n.*",
+}, {
+	about:       "remote address",
+	args:        []string{"proxy", "-upstream", "http://example.com", "-addr", "192.0.2.1:8080"},
+	expectError: "usso proxy: refusing to listen on \"192.0.2.1:8080\", which is not a loopback address; use -allow-remote to allow it\n.*",
+}}
+
+func TestProxyUsage(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range proxyUsageTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, "")
+			c.Assert(te.run(test.args...), qt.Equals, 2)
+			c.Assert(te.stderr.String(), qt.Matches, "(?s)"+test.expectError)
+		})
+	}
+}
+
+func TestProxyAllowRemote(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	te.storeToken(c, srv, "default")
+	for _, addr := range []string{"127.0.0.1:8080", "[::1]:8080"} {
+		_, got, err := newProxy(te.env, []string{"-upstream", srv.URL, "-addr", addr})
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, addr)
+	}
+	_, addr, err := newProxy(te.env, []string{"-upstream", srv.URL, "-addr", ":8080", "-allow-remote"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, ":8080")
+}
+
+func TestProxyAllowedHosts(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	te.storeToken(c, srv, "default")
+	sp, _, err := newProxy(te.env, []string{"-allow", "a.example.com, *.b.example.com", "-allow", "localhost:8080", "-quiet"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(sp.AllowedHosts, qt.DeepEquals, []string{"a.example.com", "*.b.example.com", "localhost:8080"})
+	c.Assert(sp.Upstream, qt.IsNil)
+	c.Assert(sp.Log, qt.IsNil)
+}
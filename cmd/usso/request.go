@@ -0,0 +1,297 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// headerFlags implements flag.Value for a repeated header flag.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(s string) error {
+	if i := strings.Index(s, ":"); i <= 0 {
+		return errgo.Newf("invalid header %q (want name: value)", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// requestFlags holds the flags that describe a request to sign.
+type requestFlags struct {
+	profile      *string
+	headers      headerFlags
+	data         string
+	method       string
+	strict       bool
+	transmission string
+	debug        bool
+}
+
+// register registers the flags on fs.
+func (f *requestFlags) register(e *env, fs *flag.FlagSet) {
+	f.profile = e.profileFlag(fs)
+	fs.Var(&f.headers, "H", "add the request `header` \"name: value\"; may be repeated")
+	fs.StringVar(&f.data, "d", "", "request body; @file reads it from a file and @- from standard input")
+	fs.StringVar(&f.method, "signature-method", "HMAC-SHA1", "signature `method`, HMAC-SHA1 or PLAINTEXT")
+	fs.BoolVar(&f.strict, "strict", false, "sign in strict conformance with RFC 5849")
+	fs.StringVar(&f.transmission, "transmission", "header", "send the OAuth parameters in the `place` given: header, query or form")
+	fs.BoolVar(&f.debug, "debug", false, "print the signature base string to standard error")
+}
+
+// signedRequest holds a request signed with stored credentials.
+type signedRequest struct {
+	req     *http.Request
+	body    []byte
+	profile *profile
+	rp      *usso.RequestParameters
+}
+
+// newSignedRequest creates the request described by the flags and the
+// [method] url arguments and signs it with the credentials of the
+// selected profile.
+func (f *requestFlags) newSignedRequest(e *env, args []string) (*signedRequest, error) {
+	var method, rawURL string
+	switch len(args) {
+	case 1:
+		method, rawURL = "GET", args[0]
+		if f.data != "" {
+			method = "POST"
+		}
+	case 2:
+		method, rawURL = strings.ToUpper(args[0]), args[1]
+	default:
+		return nil, usagef("need [method] url")
+	}
+	var sm usso.SignatureMethod
+	var debug func(*usso.SignatureDebug)
+	switch strings.ToUpper(f.method) {
+	case "HMAC-SHA1":
+		if f.debug {
+			debug = func(d *usso.SignatureDebug) {
+				fmt.Fprintf(e.stderr, "normalized URL: %s\n", d.NormalizedURL)
+				for _, p := range d.NormalizedParameters {
+					fmt.Fprintf(e.stderr, "parameter: %s\n", p)
+				}
+				fmt.Fprintf(e.stderr, "base string: %s\n", d.BaseString)
+			}
+		}
+		sm = usso.HMACSHA1{}
+	case "PLAINTEXT":
+		if f.debug {
+			fmt.Fprintf(e.stderr, "PLAINTEXT signatures have no base string\n")
+		}
+		sm = usso.PLAINTEXT{}
+	default:
+		return nil, usagef("unknown signature method %q", f.method)
+	}
+	var transmission usso.ParameterTransmission
+	switch f.transmission {
+	case "header":
+		transmission = usso.AuthorizationHeader
+	case "query":
+		transmission = usso.QueryString
+	case "form":
+		transmission = usso.FormBody
+	default:
+		return nil, usagef("unknown transmission %q", f.transmission)
+	}
+	body, err := f.body(e)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return nil, errgo.Newf("invalid URL %q", rawURL)
+	}
+	store, err := e.loadStore()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	p, err := store.profile(*f.profile)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, h := range f.headers {
+		i := strings.Index(h, ":")
+		req.Header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		if json.Valid(body) {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	params := req.URL.Query()
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid form body")
+		}
+		for k, v := range form {
+			params[k] = append(params[k], v...)
+		}
+	}
+	rp := &usso.RequestParameters{
+		HTTPMethod:      method,
+		BaseURL:         req.URL.String(),
+		Params:          params,
+		SignatureMethod: sm,
+		Strict:          f.strict,
+		Debug:           debug,
+		Transmission:    transmission,
+	}
+	if err := p.Credentials.SignRequest(rp, req); err != nil {
+		return nil, errgo.Notef(err, "cannot sign request")
+	}
+	if transmission == usso.FormBody {
+		// The signature parameters have been added to the body.
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return &signedRequest{
+		req:     req,
+		body:    body,
+		profile: p,
+		rp:      rp,
+	}, nil
+}
+
+// body returns the request body given by the -d flag, or nil if there
+// is none.
+func (f *requestFlags) body(e *env) ([]byte, error) {
+	switch {
+	case f.data == "":
+		return nil, nil
+	case f.data == "@-":
+		return ioutil.ReadAll(e.stdin)
+	case strings.HasPrefix(f.data, "@"):
+		return ioutil.ReadFile(f.data[1:])
+	}
+	return []byte(f.data), nil
+}
+
+// runSign runs the sign command.
+func runSign(e *env, args []string) error {
+	fs := e.newFlagSet("sign")
+	var rf requestFlags
+	rf.register(e, fs)
+	curl := fs.Bool("curl", false, "print a curl command that sends the signed request")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	sr, err := rf.newSignedRequest(e, fs.Args())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if *curl {
+		fmt.Fprintln(e.stdout, sr.curlCommand())
+		return nil
+	}
+	switch sr.rp.Transmission {
+	case usso.QueryString:
+		fmt.Fprintln(e.stdout, sr.req.URL)
+	case usso.FormBody:
+		fmt.Fprintf(e.stdout, "%s\n", sr.body)
+	default:
+		fmt.Fprintf(e.stdout, "Authorization: %s\n", sr.req.Header.Get("Authorization"))
+	}
+	return nil
+}
+
+// curlCommand returns a curl command line that sends the request.
+func (sr *signedRequest) curlCommand() string {
+	args := []string{"curl", "-X", sr.req.Method}
+	names := make([]string, 0, len(sr.req.Header))
+	for name := range sr.req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range sr.req.Header[name] {
+			args = append(args, "-H", shellQuote(name+": "+v))
+		}
+	}
+	if sr.body != nil {
+		args = append(args, "--data-binary", shellQuote(string(sr.body)))
+	}
+	args = append(args, shellQuote(sr.req.URL.String()))
+	return strings.Join(args, " ")
+}
+
+// shellSafe matches strings that need no quoting in a POSIX shell.
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s for use as a single word in a POSIX shell.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runRequest runs the request command.
+func runRequest(e *env, args []string) error {
+	fs := e.newFlagSet("request")
+	var rf requestFlags
+	rf.register(e, fs)
+	include := fs.Bool("i", false, "include the response status and headers in the output")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	sr, err := rf.newSignedRequest(e, fs.Args())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	client := &http.Client{
+		CheckRedirect: sr.profile.Credentials.CheckRedirect(sr.rp),
+	}
+	resp, err := client.Do(sr.req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if *include {
+		fmt.Fprintf(e.stdout, "%s %s\n", resp.Proto, resp.Status)
+		resp.Header.Write(e.stdout)
+		fmt.Fprintln(e.stdout)
+	}
+	if _, err := io.Copy(e.stdout, resp.Body); err != nil {
+		return errgo.Mask(err)
+	}
+	if resp.StatusCode >= 400 {
+		return errgo.Newf("server returned %s", resp.Status)
+	}
+	return nil
+}
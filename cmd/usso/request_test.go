@@ -0,0 +1,174 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+)
+
+// storeToken adds a token for email to srv and stores it in the
+// credential store of te under the named profile.
+func (te *testEnv) storeToken(c *qt.C, srv *ussotest.Server, profileName string) *usso.SSOData {
+	ssodata := srv.AddToken(email, "my-token")
+	store, err := loadStore(te.storePath)
+	c.Assert(err, qt.IsNil)
+	store.Profiles[profileName] = &profile{
+		Server:      srv.URL,
+		Email:       email,
+		Credentials: ssodata,
+	}
+	err = store.save(te.storePath)
+	c.Assert(err, qt.IsNil)
+	return ssodata
+}
+
+func TestRequest(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "default")
+	for _, args := range [][]string{
+		nil,
+		{"-strict"},
+		{"-signature-method", "PLAINTEXT"},
+		{"-signature-method", "plaintext", "-strict"},
+	} {
+		args = append(args, srv.URL+"/api/v2/tokens/oauth/"+ssodata.TokenKey)
+		code := te.run(append([]string{"request"}, args...)...)
+		c.Assert(code, qt.Equals, 0, qt.Commentf("%v: %s", args, &te.stderr))
+		var details usso.TokenDetails
+		err := json.Unmarshal(te.stdout.Bytes(), &details)
+		c.Assert(err, qt.IsNil)
+		c.Assert(details.TokenKey, qt.Equals, ssodata.TokenKey)
+	}
+
+	code := te.run("request", "-i", "DELETE", srv.URL+"/api/v2/tokens/oauth/no-such-token")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stdout.String(), qt.Matches, `(?s)HTTP/1.1 404 Not Found\r?\n.*"code": ?"RESOURCE_NOT_FOUND".*`)
+	c.Assert(te.stderr.String(), qt.Equals, "usso request: server returned 404 Not Found\n")
+}
+
+func TestRequestBody(t *testing.T) {
+	c := qt.New(t)
+
+	var gotContentType, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotContentType = req.Header.Get("Content-Type")
+		data, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(data)
+	}))
+	defer upstream.Close()
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	te.storeToken(c, srv, "default")
+
+	code := te.run("request", "-d", `{"a": 1}`, upstream.URL)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(gotContentType, qt.Equals, "application/json")
+	c.Assert(gotBody, qt.Equals, `{"a": 1}`)
+
+	path := filepath.Join(c.Mkdir(), "body")
+	err := ioutil.WriteFile(path, []byte("a=b"), 0600)
+	c.Assert(err, qt.IsNil)
+	code = te.run("request", "-transmission", "form", "-d", "@"+path, "PUT", upstream.URL)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(gotContentType, qt.Equals, "application/x-www-form-urlencoded")
+	c.Assert(gotBody, qt.Matches, "a=b&oauth_consumer_key=.*&oauth_signature=.*")
+}
+
+func TestSign(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "work")
+
+	code := te.run("sign", "-profile", "work", "https://example.com/path?a=b")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Matches, `Authorization: OAuth realm="API", .*oauth_signature=.*\n`)
+
+	code = te.run("sign", "-profile", "work", "-transmission", "query", "https://example.com/path?a=b")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Matches, `https://example.com/path\?a=b&oauth_consumer_key=`+ssodata.ConsumerKey+`&.*oauth_signature=.*\n`)
+
+	code = te.run("sign", "-profile", "work", "-debug", "-H", "X-Foo: it's", "-d", "x=y", "https://example.com/path?a=b")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stderr.String(), qt.Matches, `(?s)normalized URL: https://example.com/path
+parameter: a=b
+.*parameter: x=y
+base string: POST&https%3A%2F%2Fexample.com%2Fpath&a%3Db%26.*x%3Dy
+`)
+
+	code = te.run("sign", "-profile", "work", "-curl", "-H", "X-Foo: it's", "-d", "x=y", "https://example.com/path?a=b")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	cmd := strings.TrimSpace(te.stdout.String())
+	c.Assert(cmd, qt.Matches, `curl -X POST -H 'Authorization: OAuth .*' -H 'Content-Type: application/x-www-form-urlencoded' -H 'X-Foo: it'\\''s' --data-binary x=y 'https://example.com/path\?a=b'`)
+	if _, err := exec.LookPath("sh"); err == nil {
+		// Check that the quoting survives the shell.
+		out, err := exec.Command("sh", "-c", "printf '%s\\n' "+strings.TrimPrefix(cmd, "curl ")).Output()
+		c.Assert(err, qt.IsNil)
+		c.Assert(strings.Split(string(out), "\n")[7], qt.Equals, "X-Foo: it's")
+	}
+}
+
+var requestUsageTests = []struct {
+	about       string
+	args        []string
+	expectError string
+}{{
+	about:       "no url",
+	args:        []string{"sign"},
+	expectError: "usso sign: need \\[method\\] url\n.*",
+}, {
+	about:       "bad signature method",
+	args:        []string{"sign", "-signature-method", "RSA-SHA1", "http://example.com"},
+	expectError: "usso sign: unknown signature method \"RSA-SHA1\"\n.*",
+}, {
+	about:       "bad transmission",
+	args:        []string{"request", "-transmission", "carrier-pigeon", "http://example.com"},
+	expectError: "usso request: unknown transmission \"carrier-pigeon\"\n.*",
+}, {
+	about:       "bad header",
+	args:        []string{"request", "-H", "foo", "http://example.com"},
+	expectError: "invalid value \"foo\" for flag -H: invalid header \"foo\" \\(want name: value\\)\n.*",
+}}
+
+func TestRequestUsage(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range requestUsageTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, "")
+			c.Assert(te.run(test.args...), qt.Equals, 2)
+			c.Assert(te.stderr.String(), qt.Matches, "(?s)"+test.expectError)
+		})
+	}
+}
+
+func TestSignNoProfile(t *testing.T) {
+	c := qt.New(t)
+
+	te := newTestEnv(c, "")
+	c.Assert(te.run("sign", "http://example.com"), qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Equals, "usso sign: no credentials for profile \"default\"; run \"usso login\" first\n")
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// profile holds the credentials stored under a profile name.
+type profile struct {
+	// Server holds the base URL of the Ubuntu SSO server that issued
+	// the credentials.
+	Server string `json:"server"`
+
+	// Email holds the email address of the account the credentials
+	// belong to.
+	Email string `json:"email,omitempty"`
+
+	// Credentials holds the OAuth credentials.
+	Credentials *usso.SSOData `json:"credentials"`
+}
+
+// server returns the Ubuntu SSO server that issued the credentials.
+func (p *profile) server() usso.UbuntuSSOServer {
+	return serverForURL(p.Server)
+}
+
+// serverForURL returns the Ubuntu SSO server with the given base URL,
+// using the predefined servers where possible so that their token
+// registration URLs are kept.
+func serverForURL(u string) usso.UbuntuSSOServer {
+	for _, s := range []usso.UbuntuSSOServer{
+		usso.ProductionUbuntuSSOServer,
+		usso.StagingUbuntuSSOServer,
+	} {
+		if s.LoginURL() == u {
+			return s
+		}
+	}
+	return usso.NewUbuntuSSOServer(u, "")
+}
+
+// credentialStore holds the contents of the credential store.
+type credentialStore struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// defaultStorePath returns the path of the credential store used when
+// USSO_CREDENTIALS is not set.
+func defaultStorePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return filepath.Join(dir, "usso", "credentials.json"), nil
+}
+
+// loadStore reads the credential store at path. If the file does not
+// exist an empty store is returned.
+func loadStore(path string) (*credentialStore, error) {
+	s := &credentialStore{
+		Profiles: make(map[string]*profile),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", path)
+	}
+	if s.Profiles == nil {
+		s.Profiles = make(map[string]*profile)
+	}
+	return s, nil
+}
+
+// save writes the store to path. The file is created with permissions
+// that only allow its owner to read it, and is replaced atomically.
+func (s *credentialStore) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(writePrivateFile(path, append(data, '\n')))
+}
+
+// writePrivateFile writes data to the named file, replacing it if it
+// exists, so that the file is only readable by its owner.
+func writePrivateFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".credentials")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// TempFile creates the file with mode 0600, so the credentials are
+	// never readable by others, even if the file existed before with a
+	// different mode.
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// profile returns the profile with the given name.
+func (s *credentialStore) profile(name string) (*profile, error) {
+	p, ok := s.Profiles[name]
+	if !ok || p.Credentials == nil {
+		return nil, errgo.Newf("no credentials for profile %q; run \"usso login\" first", name)
+	}
+	return p, nil
+}
+
+// credentialsPath returns the path of the credential store.
+func (e *env) credentialsPath() (string, error) {
+	if e.storePath != "" {
+		return e.storePath, nil
+	}
+	return defaultStorePath()
+}
+
+// loadStore reads the credential store.
+func (e *env) loadStore() (*credentialStore, error) {
+	path, err := e.credentialsPath()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return loadStore(path)
+}
+
+// saveStore writes s to the credential store.
+func (e *env) saveStore(s *credentialStore) error {
+	path, err := e.credentialsPath()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return s.save(path)
+}
+
+// profileFlag registers the -profile flag on fs.
+func (e *env) profileFlag(fs *flag.FlagSet) *string {
+	def := e.defaultProfile
+	if def == "" {
+		def = "default"
+	}
+	return fs.String("profile", def, "`name` of the credential profile")
+}
@@ -0,0 +1,357 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// exitInvalidToken is the exit status of the token commands when the
+// server rejects the stored token. Other errors, such as failing to
+// reach the server, exit with status 1.
+const exitInvalidToken = 3
+
+var tokenCommands = []command{{
+	name:    "info",
+	args:    "[flags]",
+	summary: "show the details of the stored token",
+	run:     runTokenInfo,
+}, {
+	name:    "validate",
+	args:    "[flags]",
+	summary: "check that the stored token is valid",
+	run:     runTokenValidate,
+}, {
+	name:    "list",
+	args:    "[flags]",
+	summary: "list the tokens of the account",
+	run:     runTokenList,
+}, {
+	name:    "revoke",
+	args:    "[flags] [key...]",
+	summary: "revoke tokens of the account",
+	run:     runTokenRevoke,
+}}
+
+// tokenFlags holds the flags common to the token commands.
+type tokenFlags struct {
+	profile *string
+	json    bool
+}
+
+// register registers the flags on fs.
+func (f *tokenFlags) register(e *env, fs *flag.FlagSet) {
+	f.profile = e.profileFlag(fs)
+	fs.BoolVar(&f.json, "json", false, "print the result as JSON")
+}
+
+// loadProfile returns the profile selected by the flags.
+func (f *tokenFlags) loadProfile(e *env) (*profile, error) {
+	store, err := e.loadStore()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return store.profile(*f.profile)
+}
+
+// parseTokenFlags creates the flag set for the named token command,
+// registers the common flags and any others added by register, and
+// parses args.
+func parseTokenFlags(e *env, name string, args []string, register func(fs *flag.FlagSet)) (*tokenFlags, *flag.FlagSet, error) {
+	fs := e.newFlagSet("token " + name)
+	var tf tokenFlags
+	tf.register(e, fs)
+	if register != nil {
+		register(fs)
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return nil, nil, err
+	}
+	return &tf, fs, nil
+}
+
+// tokenError returns the error for a failed request made with the
+// stored token, exiting with exitInvalidToken if the server rejected
+// the token.
+func tokenError(err error, format string, a ...interface{}) error {
+	invalid := usso.IsInvalidToken(err)
+	err = errgo.Notef(err, format, a...)
+	if invalid {
+		return &exitError{code: exitInvalidToken, err: err}
+	}
+	return err
+}
+
+// runTokenInfo runs the token info command.
+func runTokenInfo(e *env, args []string) error {
+	tf, fs, err := parseTokenFlags(e, "info", args, nil)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	p, err := tf.loadProfile(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data, err := p.server().GetTokenDetailsContext(context.Background(), p.Credentials)
+	if err != nil {
+		return tokenError(err, "cannot get token details")
+	}
+	var td usso.TokenDetails
+	if err := json.Unmarshal([]byte(data), &td); err != nil {
+		return errgo.Notef(err, "cannot parse token details")
+	}
+	if tf.json {
+		return writeJSON(e.stdout, td)
+	}
+	w := tabwriter.NewWriter(e.stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Profile:\t%s\n", *tf.profile)
+	fmt.Fprintf(w, "Server:\t%s\n", p.Server)
+	if p.Email != "" {
+		fmt.Fprintf(w, "Email:\t%s\n", p.Email)
+	}
+	fmt.Fprintf(w, "Name:\t%s\n", td.TokenName)
+	fmt.Fprintf(w, "Key:\t%s\n", td.TokenKey)
+	fmt.Fprintf(w, "Consumer:\t%s\n", td.ConsumerKey)
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(td.Created))
+	fmt.Fprintf(w, "Updated:\t%s\n", formatTime(td.Updated))
+	return w.Flush()
+}
+
+// runTokenValidate runs the token validate command.
+func runTokenValidate(e *env, args []string) error {
+	tf, fs, err := parseTokenFlags(e, "validate", args, nil)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	p, err := tf.loadProfile(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	valid, err := p.server().IsTokenValidContext(context.Background(), p.Credentials)
+	if err != nil && !usso.IsInvalidToken(err) {
+		return errgo.Notef(err, "cannot validate token")
+	}
+	if tf.json {
+		result := struct {
+			Profile string `json:"profile"`
+			Valid   bool   `json:"valid"`
+			Error   string `json:"error,omitempty"`
+		}{
+			Profile: *tf.profile,
+			Valid:   valid,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := writeJSON(e.stdout, result); err != nil {
+			return errgo.Mask(err)
+		}
+	} else if valid {
+		fmt.Fprintf(e.stdout, "Token %q of profile %q is valid.\n", p.Credentials.TokenName, *tf.profile)
+	} else {
+		fmt.Fprintf(e.stdout, "Token %q of profile %q is not valid.\n", p.Credentials.TokenName, *tf.profile)
+	}
+	if !valid {
+		return &exitError{code: exitInvalidToken}
+	}
+	return nil
+}
+
+// runTokenList runs the token list command.
+func runTokenList(e *env, args []string) error {
+	tf, fs, err := parseTokenFlags(e, "list", args, nil)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	p, err := tf.loadProfile(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tokens, err := p.server().ListTokens(context.Background(), p.Credentials)
+	if err != nil {
+		return tokenError(err, "cannot list tokens")
+	}
+	if tf.json {
+		if tokens == nil {
+			tokens = []usso.TokenDetails{}
+		}
+		return writeJSON(e.stdout, tokens)
+	}
+	return writeTokenTable(e.stdout, tokens, p.Credentials.TokenKey)
+}
+
+// writeTokenTable writes a table of the given tokens to w. The token
+// with the key current is marked with an asterisk.
+func writeTokenTable(w io.Writer, tokens []usso.TokenDetails, current string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\tNAME\tKEY\tCREATED\tUPDATED\n")
+	for _, td := range tokens {
+		mark := ""
+		if td.TokenKey == current {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", mark, td.TokenName, td.TokenKey, formatTime(td.Created), formatTime(td.Updated))
+	}
+	return tw.Flush()
+}
+
+// runTokenRevoke runs the token revoke command.
+func runTokenRevoke(e *env, args []string) error {
+	var namePrefix, createdBefore, unusedSince string
+	tf, fs, err := parseTokenFlags(e, "revoke", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&namePrefix, "name-prefix", "", "revoke the tokens whose names start with `prefix`")
+		fs.StringVar(&createdBefore, "created-before", "", "revoke the tokens created before `time`, a date, an RFC 3339 time or a duration before now such as 30d or 12h")
+		fs.StringVar(&unusedSince, "unused-since", "", "revoke the tokens not used since `time`, a date, an RFC 3339 time or a duration before now such as 30d or 12h")
+	})
+	if err != nil {
+		return err
+	}
+	var match []func(usso.TokenDetails) bool
+	if namePrefix != "" {
+		match = append(match, usso.TokenNameHasPrefix(namePrefix))
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		match func(time.Time) func(usso.TokenDetails) bool
+	}{
+		{"created-before", createdBefore, usso.TokenCreatedBefore},
+		{"unused-since", unusedSince, usso.TokenUnusedSince},
+	} {
+		if f.value == "" {
+			continue
+		}
+		t, err := parseTimeFlag(f.value, time.Now())
+		if err != nil {
+			return usagef("invalid -%s value %q", f.name, f.value)
+		}
+		match = append(match, f.match(t))
+	}
+	keys := fs.Args()
+	switch {
+	case len(keys) == 0 && len(match) == 0:
+		return usagef("no tokens given to revoke")
+	case len(keys) > 0 && len(match) > 0:
+		return usagef("cannot give both token keys and filters")
+	}
+	p, err := tf.loadProfile(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ctx := context.Background()
+	server := p.server()
+	var revoked []usso.TokenDetails
+	if len(keys) > 0 {
+		for _, key := range keys {
+			if key == p.Credentials.TokenKey {
+				return errgo.Newf("cannot revoke the token of profile %q; use \"usso logout\" instead", *tf.profile)
+			}
+		}
+		for _, key := range keys {
+			if err := server.RevokeToken(ctx, p.Credentials, key); err != nil {
+				return revokeError(e, tf, revoked, tokenError(err, "cannot revoke token %q", key))
+			}
+			revoked = append(revoked, usso.TokenDetails{TokenKey: key})
+		}
+	} else {
+		revoked, err = server.RevokeTokens(ctx, p.Credentials, func(td usso.TokenDetails) bool {
+			for _, m := range match {
+				if !m(td) {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return revokeError(e, tf, revoked, tokenError(err, "cannot revoke tokens"))
+		}
+	}
+	return writeRevoked(e, tf, revoked)
+}
+
+// revokeError writes the tokens that were revoked before revoking
+// failed with err, and returns err.
+func revokeError(e *env, tf *tokenFlags, revoked []usso.TokenDetails, err error) error {
+	if len(revoked) > 0 {
+		writeRevoked(e, tf, revoked)
+	}
+	return err
+}
+
+// writeRevoked writes the tokens that were revoked to e.stdout.
+func writeRevoked(e *env, tf *tokenFlags, revoked []usso.TokenDetails) error {
+	if tf.json {
+		if revoked == nil {
+			revoked = []usso.TokenDetails{}
+		}
+		return writeJSON(e.stdout, revoked)
+	}
+	for _, td := range revoked {
+		if td.TokenName != "" {
+			fmt.Fprintf(e.stdout, "Revoked %s (%s).\n", td.TokenKey, td.TokenName)
+		} else {
+			fmt.Fprintf(e.stdout, "Revoked %s.\n", td.TokenKey)
+		}
+	}
+	if len(revoked) == 0 {
+		fmt.Fprintf(e.stderr, "No tokens matched.\n")
+	}
+	return nil
+}
+
+// parseTimeFlag parses the value of a flag that holds a time, given as
+// a date, an RFC 3339 time or a duration before now. As well as the
+// units accepted by time.ParseDuration, a duration may be a whole number
+// of days with the suffix "d".
+func parseTimeFlag(s string, now time.Time) (time.Time, error) {
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") && n >= 0 {
+		return now.AddDate(0, 0, -n), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// formatTime formats a token time for display.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errgo.Mask(err)
+}
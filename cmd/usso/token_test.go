@@ -0,0 +1,222 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+)
+
+func TestTokenInfo(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "default")
+
+	code := te.run("token", "info")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Matches, `Profile:  default
+Server:   `+srv.URL+`
+Email:    foo@bar.com
+Name:     my-token
+Key:      `+ssodata.TokenKey+`
+Consumer: `+ssodata.ConsumerKey+`
+Created:  \d{4}-\d\d-\d\d \d\d:\d\d:\d\d
+Updated:  .*
+`)
+
+	code = te.run("token", "info", "-json")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	var td usso.TokenDetails
+	err := json.Unmarshal(te.stdout.Bytes(), &td)
+	c.Assert(err, qt.IsNil)
+	c.Assert(td.TokenKey, qt.Equals, ssodata.TokenKey)
+	c.Assert(td.TokenName, qt.Equals, "my-token")
+
+	revokeStored(c, srv, ssodata)
+	code = te.run("token", "info")
+	c.Assert(code, qt.Equals, exitInvalidToken)
+	c.Assert(te.stderr.String(), qt.Equals, "usso token info: cannot get token details: INVALID_CREDENTIALS\n")
+}
+
+// revokeStored revokes the given token.
+func revokeStored(c *qt.C, srv *ussotest.Server, ssodata *usso.SSOData) {
+	err := srv.UbuntuSSOServer().RevokeToken(context.Background(), ssodata, ssodata.TokenKey)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestTokenValidate(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "default")
+
+	code := te.run("token", "validate")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, "Token \"my-token\" of profile \"default\" is valid.\n")
+
+	code = te.run("token", "validate", "-json")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.JSONEquals, map[string]interface{}{
+		"profile": "default",
+		"valid":   true,
+	})
+
+	// Transport errors are distinguished from invalid tokens.
+	srv.AddFault(ussotest.ServiceUnavailable("GET", "", 1, ""))
+	code = te.run("token", "validate")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stdout.String(), qt.Equals, "")
+	c.Assert(te.stderr.String(), qt.Matches, "usso token validate: cannot validate token: .*\n")
+
+	revokeStored(c, srv, ssodata)
+	code = te.run("token", "validate")
+	c.Assert(code, qt.Equals, exitInvalidToken)
+	c.Assert(te.stdout.String(), qt.Equals, "Token \"my-token\" of profile \"default\" is not valid.\n")
+	c.Assert(te.stderr.String(), qt.Equals, "")
+
+	code = te.run("token", "validate", "-json")
+	c.Assert(code, qt.Equals, exitInvalidToken)
+	c.Assert(te.stdout.String(), qt.JSONEquals, map[string]interface{}{
+		"profile": "default",
+		"valid":   false,
+		"error":   "INVALID_CREDENTIALS",
+	})
+}
+
+func TestTokenList(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	other := srv.AddTokenCredentials(email, "other", "other-key", "other-secret")
+	ssodata := te.storeToken(c, srv, "default")
+
+	code := te.run("token", "list")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Matches, `   NAME +KEY +CREATED +UPDATED *\n(.*\n){2}`)
+	c.Assert(te.stdout.String(), qt.Matches, `(?s).*\n\* +my-token +`+ssodata.TokenKey+` .*`)
+	c.Assert(te.stdout.String(), qt.Matches, `(?s).*\n   other +`+other.TokenKey+` .*`)
+
+	code = te.run("token", "list", "-json")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	var tokens []usso.TokenDetails
+	err := json.Unmarshal(te.stdout.Bytes(), &tokens)
+	c.Assert(err, qt.IsNil)
+	c.Assert(tokens, qt.HasLen, 2)
+}
+
+func TestTokenRevoke(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	te := newTestEnv(c, "")
+	ssodata := te.storeToken(c, srv, "default")
+	srv.AddTokenCredentials(email, "bot-1", "bot-1-key", "secret")
+	srv.AddTokenCredentials(email, "bot-2", "bot-2-key", "secret")
+	srv.AddTokenCredentials(email, "laptop", "laptop-key", "secret")
+
+	code := te.run("token", "revoke", ssodata.TokenKey)
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Equals, "usso token revoke: cannot revoke the token of profile \"default\"; use \"usso logout\" instead\n")
+
+	code = te.run("token", "revoke", "-name-prefix", "bot-", "-json")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	var revoked []usso.TokenDetails
+	err := json.Unmarshal(te.stdout.Bytes(), &revoked)
+	c.Assert(err, qt.IsNil)
+	c.Assert(revoked, qt.HasLen, 2)
+
+	code = te.run("token", "revoke", "-name-prefix", "bot-")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, "")
+	c.Assert(te.stderr.String(), qt.Equals, "No tokens matched.\n")
+
+	code = te.run("token", "revoke", "laptop-key")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("%s", &te.stderr))
+	c.Assert(te.stdout.String(), qt.Equals, "Revoked laptop-key.\n")
+	tokens := srv.Tokens(email)
+	c.Assert(tokens, qt.HasLen, 1)
+	c.Assert(tokens[0].TokenKey, qt.Equals, ssodata.TokenKey)
+
+	code = te.run("token", "revoke", "laptop-key")
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(te.stderr.String(), qt.Matches, "usso token revoke: cannot revoke token \"laptop-key\": .*\n")
+}
+
+var tokenUsageTests = []struct {
+	about       string
+	args        []string
+	expectError string
+}{{
+	about:       "no subcommand",
+	args:        []string{"token"},
+	expectError: "usage: usso token <command> .*Run \"usso help token <command>\".*",
+}, {
+	about:       "unknown subcommand",
+	args:        []string{"token", "frob"},
+	expectError: "usso token: unknown command \"frob\"\n.*",
+}, {
+	about:       "unexpected arguments",
+	args:        []string{"token", "list", "foo"},
+	expectError: "usso token list: unexpected arguments \\[\"foo\"\\]\nusage: usso token list \\[flags\\]\n",
+}, {
+	about:       "nothing to revoke",
+	args:        []string{"token", "revoke"},
+	expectError: "usso token revoke: no tokens given to revoke\n.*",
+}, {
+	about:       "keys and filters",
+	args:        []string{"token", "revoke", "-name-prefix", "x", "key"},
+	expectError: "usso token revoke: cannot give both token keys and filters\n.*",
+}, {
+	about:       "invalid time",
+	args:        []string{"token", "revoke", "-unused-since", "last tuesday"},
+	expectError: "usso token revoke: invalid -unused-since value \"last tuesday\"\n.*",
+}}
+
+func TestTokenUsage(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range tokenUsageTests {
+		c.Run(test.about, func(c *qt.C) {
+			te := newTestEnv(c, "")
+			c.Assert(te.run(test.args...), qt.Equals, 2)
+			c.Assert(te.stderr.String(), qt.Matches, "(?s)"+test.expectError)
+		})
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2016, 5, 10, 12, 0, 0, 0, time.UTC)
+	for s, expect := range map[string]time.Time{
+		"720h":                 now.Add(-720 * time.Hour),
+		"30d":                  time.Date(2016, 4, 10, 12, 0, 0, 0, time.UTC),
+		"0d":                   now,
+		"2016-01-02":           time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+		"2016-01-02T03:04:05Z": time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		t, err := parseTimeFlag(s, now)
+		c.Assert(err, qt.IsNil)
+		c.Assert(t.Equal(expect), qt.IsTrue, qt.Commentf("%s: got %v", s, t))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+const (
+	// dischargePath is the path where third-party caveats addressed
+	// to Ubuntu SSO can be discharged.
+	dischargePath = "/api/v2/tokens/discharge"
+
+	// refreshPath is the path where discharge macaroons can be
+	// refreshed.
+	refreshPath = "/api/v2/tokens/refresh"
+)
+
+// DischargeMacaroon discharges the third-party caveat with the given ID,
+// which must be addressed to the Ubuntu SSO server, by authenticating as
+// the user with the given email and password. If the user has
+// two-factor authentication enabled then otp must hold a one-time
+// password, otherwise it can be blank. If an error is returned from the
+// identity server then it will be of type *Error.
+func (server UbuntuSSOServer) DischargeMacaroon(ctx context.Context, caveatID, email, password, otp string) (*macaroon.Macaroon, error) {
+	data := map[string]string{
+		"email":     email,
+		"password":  password,
+		"caveat_id": caveatID,
+	}
+	if otp != "" {
+		data["otp"] = otp
+	}
+	// A one-time password can only be used once, so discharging is
+	// not idempotent.
+	return server.postDischarge(ctx, dischargePath, false, data)
+}
+
+// RefreshDischarge obtains a new discharge macaroon to replace the given
+// discharge macaroon, which was obtained from the Ubuntu SSO server. If
+// an error is returned from the identity server then it will be of type
+// *Error.
+func (server UbuntuSSOServer) RefreshDischarge(ctx context.Context, discharge *macaroon.Macaroon) (*macaroon.Macaroon, error) {
+	buf, err := discharge.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{
+		"discharge_macaroon": base64.RawURLEncoding.EncodeToString(buf),
+	}
+	return server.postDischarge(ctx, refreshPath, true, data)
+}
+
+// postDischarge sends data to the given discharge endpoint and decodes
+// the discharge macaroon in the response.
+func (server UbuntuSSOServer) postDischarge(ctx context.Context, path string, idempotent bool, data map[string]string) (*macaroon.Macaroon, error) {
+	var result struct {
+		DischargeMacaroon string `json:"discharge_macaroon"`
+	}
+	if err := server.do(ctx, nil, "POST", path, idempotent, data, &result); err != nil {
+		return nil, err
+	}
+	return decodeMacaroon(result.DischargeMacaroon)
+}
+
+// decodeMacaroon decodes a base64 encoded binary macaroon.
+func decodeMacaroon(s string) (*macaroon.Macaroon, error) {
+	buf, err := macaroon.Base64Decode([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode discharge macaroon: %v", err)
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("cannot decode discharge macaroon: %v", err)
+	}
+	return &m, nil
+}
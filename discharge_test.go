@@ -0,0 +1,122 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// dischargeHandler responds to discharge and refresh requests with its
+// status and body, recording the request bodies by path.
+type dischargeHandler struct {
+	c        *qt.C
+	status   int
+	body     interface{}
+	requests map[string]map[string]string
+}
+
+func (h *dischargeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.c.Check(req.Method, qt.Equals, "POST")
+	h.c.Check(req.Header.Get("Content-Type"), qt.Equals, "application/json")
+	var data map[string]string
+	err := json.NewDecoder(req.Body).Decode(&data)
+	h.c.Check(err, qt.IsNil)
+	if h.requests == nil {
+		h.requests = make(map[string]map[string]string)
+	}
+	h.requests[req.URL.Path] = data
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(h.status)
+	json.NewEncoder(w).Encode(h.body)
+}
+
+func newMacaroon(c *qt.C, id string) *macaroon.Macaroon {
+	m, err := macaroon.New([]byte("root key"), []byte(id), "login.ubuntu.com", macaroon.V1)
+	c.Assert(err, qt.IsNil)
+	return m
+}
+
+func encodeMacaroon(c *qt.C, m *macaroon.Macaroon) string {
+	buf, err := m.MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func TestDischargeMacaroon(t *testing.T) {
+	c := qt.New(t)
+
+	m := newMacaroon(c, "discharge")
+	h := &dischargeHandler{c: c, status: http.StatusOK, body: map[string]string{
+		"discharge_macaroon": encodeMacaroon(c, m),
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	d, err := server.DischargeMacaroon(context.Background(), "caveat", email, password, otp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Id(), qt.DeepEquals, []byte("discharge"))
+	c.Assert(d.Signature(), qt.DeepEquals, m.Signature())
+	c.Assert(h.requests["/api/v2/tokens/discharge"], qt.DeepEquals, map[string]string{
+		"email":     email,
+		"password":  password,
+		"otp":       otp,
+		"caveat_id": "caveat",
+	})
+}
+
+func TestDischargeMacaroonError(t *testing.T) {
+	c := qt.New(t)
+
+	h := &dischargeHandler{c: c, status: http.StatusUnauthorized, body: map[string]interface{}{
+		"code":    "TWOFACTOR_REQUIRED",
+		"message": "2-factor authentication required.",
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	d, err := server.DischargeMacaroon(context.Background(), "caveat", email, password, "")
+	c.Assert(err, qt.ErrorMatches, `2-factor authentication required.`)
+	c.Assert(err.(*Error).Code, qt.Equals, "TWOFACTOR_REQUIRED")
+	c.Assert(d, qt.IsNil)
+}
+
+func TestDischargeMacaroonBadResponse(t *testing.T) {
+	c := qt.New(t)
+
+	h := &dischargeHandler{c: c, status: http.StatusOK, body: map[string]string{
+		"discharge_macaroon": "!!!",
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	_, err := server.DischargeMacaroon(context.Background(), "caveat", email, password, "")
+	c.Assert(err, qt.ErrorMatches, `cannot decode discharge macaroon: .*`)
+}
+
+func TestRefreshDischarge(t *testing.T) {
+	c := qt.New(t)
+
+	old := newMacaroon(c, "old")
+	m := newMacaroon(c, "new")
+	h := &dischargeHandler{c: c, status: http.StatusOK, body: map[string]string{
+		"discharge_macaroon": encodeMacaroon(c, m),
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	d, err := server.RefreshDischarge(context.Background(), old)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Id(), qt.DeepEquals, []byte("new"))
+	c.Assert(h.requests["/api/v2/tokens/refresh"], qt.DeepEquals, map[string]string{
+		"discharge_macaroon": encodeMacaroon(c, old),
+	})
+}
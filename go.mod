@@ -3,8 +3,10 @@ module github.com/juju/usso
 require (
 	github.com/frankban/quicktest v1.14.0
 	github.com/yohcop/openid-go v1.0.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	gopkg.in/errgo.v1 v1.0.1
 	gopkg.in/macaroon.v2 v2.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -12,7 +14,6 @@ require (
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.6.1 // indirect
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
 	golang.org/x/net v0.0.0-20190522155817-f3200d17e092 // indirect
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
@@ -0,0 +1,74 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"strings"
+)
+
+// LaunchpadServer represents a Launchpad instance. Launchpad issues
+// OAuth 1.0 tokens through its own authorization endpoints, using
+// PLAINTEXT signatures and an empty consumer secret.
+type LaunchpadServer struct {
+	// WebRoot holds the root URL of the Launchpad web site, which
+	// serves the +request-token, +authorize-token and +access-token
+	// endpoints.
+	WebRoot string
+
+	// ServiceRoot holds the root URL of the Launchpad API. It is used
+	// as the realm of the credentials obtained from the server.
+	ServiceRoot string
+}
+
+// ProductionLaunchpadServer represents the production Launchpad located
+// at https://launchpad.net.
+var ProductionLaunchpadServer = LaunchpadServer{
+	WebRoot:     "https://launchpad.net/",
+	ServiceRoot: "https://api.launchpad.net/",
+}
+
+// StagingLaunchpadServer represents the staging Launchpad located at
+// https://staging.launchpad.net. Use it for testing.
+var StagingLaunchpadServer = LaunchpadServer{
+	WebRoot:     "https://staging.launchpad.net/",
+	ServiceRoot: "https://api.staging.launchpad.net/",
+}
+
+// RequestTokenURL returns the URL where request tokens can be obtained.
+func (lp LaunchpadServer) RequestTokenURL() string {
+	return lp.url("+request-token")
+}
+
+// AuthorizeTokenURL returns the URL where the user authorizes a request
+// token.
+func (lp LaunchpadServer) AuthorizeTokenURL() string {
+	return lp.url("+authorize-token")
+}
+
+// AccessTokenURL returns the URL where an authorized request token can
+// be exchanged for an access token.
+func (lp LaunchpadServer) AccessTokenURL() string {
+	return lp.url("+access-token")
+}
+
+func (lp LaunchpadServer) url(path string) string {
+	return strings.TrimSuffix(lp.WebRoot, "/") + "/" + path
+}
+
+// OAuthFlow returns an OAuthFlow for obtaining an access token for the
+// named application, which Launchpad uses as the consumer key. The
+// resulting SSOData should be used to sign requests with PLAINTEXT.
+func (lp LaunchpadServer) OAuthFlow(consumerKey string) *OAuthFlow {
+	return &OAuthFlow{
+		ConsumerKey: consumerKey,
+		Realm:       lp.ServiceRoot,
+		Endpoints: OAuthEndpoints{
+			RequestTokenURL: lp.RequestTokenURL(),
+			AuthorizeURL:    lp.AuthorizeTokenURL(),
+			AccessTokenURL:  lp.AccessTokenURL(),
+		},
+		SignatureMethod: PLAINTEXT{},
+		Transmission:    FormBody,
+	}
+}
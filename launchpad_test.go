@@ -0,0 +1,108 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// launchpadServer is a stand-in for the Launchpad token endpoints.
+type launchpadServer struct {
+	c *qt.C
+}
+
+func (s launchpadServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := s.c
+	c.Check(req.Method, qt.Equals, "POST")
+	c.Check(req.Header.Get("Authorization"), qt.Equals, "")
+	err := req.ParseForm()
+	c.Check(err, qt.IsNil)
+	if req.PostForm.Get("oauth_consumer_key") != "my-app" || req.PostForm.Get("oauth_signature_method") != "PLAINTEXT" {
+		http.Error(w, "bad consumer", http.StatusUnauthorized)
+		return
+	}
+	switch req.URL.Path {
+	case "/+request-token":
+		if req.PostForm.Get("oauth_signature") != "&" {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("oauth_token=request-token&oauth_token_secret=request-secret"))
+	case "/+access-token":
+		if req.PostForm.Get("oauth_token") != "request-token" || req.PostForm.Get("oauth_signature") != "&request-secret" {
+			http.Error(w, "Request token has not yet been reviewed. Try again later.", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("oauth_token=access-token&oauth_token_secret=access-secret&lp.context=None"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestLaunchpadURLs(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(ProductionLaunchpadServer.RequestTokenURL(), qt.Equals, "https://launchpad.net/+request-token")
+	c.Assert(ProductionLaunchpadServer.AuthorizeTokenURL(), qt.Equals, "https://launchpad.net/+authorize-token")
+	c.Assert(ProductionLaunchpadServer.AccessTokenURL(), qt.Equals, "https://launchpad.net/+access-token")
+	c.Assert(StagingLaunchpadServer.RequestTokenURL(), qt.Equals, "https://staging.launchpad.net/+request-token")
+}
+
+func TestLaunchpadOAuthFlow(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(launchpadServer{c})
+	defer srv.Close()
+	lp := LaunchpadServer{
+		WebRoot:     srv.URL,
+		ServiceRoot: "https://api.launchpad.test/",
+	}
+	flow := lp.OAuthFlow("my-app")
+	flow.Callback = "http://localhost:8080/done"
+	ctx := context.Background()
+
+	rt, err := flow.RequestToken(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rt, qt.DeepEquals, &RequestToken{
+		Token:  "request-token",
+		Secret: "request-secret",
+	})
+	c.Assert(flow.AuthorizationURL(rt), qt.Equals, srv.URL+"/+authorize-token?oauth_callback=http%3A%2F%2Flocalhost%3A8080%2Fdone&oauth_token=request-token")
+
+	ssodata, err := flow.AccessToken(ctx, rt, "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata, qt.DeepEquals, &SSOData{
+		ConsumerKey: "my-app",
+		Realm:       "https://api.launchpad.test/",
+		TokenKey:    "access-token",
+		TokenSecret: "access-secret",
+	})
+
+	// The credentials can be used to sign API requests.
+	req, err := http.NewRequest("GET", "https://api.launchpad.test/devel/people/+me", nil)
+	c.Assert(err, qt.IsNil)
+	rp := RequestParameters{
+		HTTPMethod:      "GET",
+		BaseURL:         req.URL.String(),
+		SignatureMethod: PLAINTEXT{},
+	}
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(req.Header.Get("Authorization"), qt.Matches, `OAuth realm="https%3A%2F%2Fapi.launchpad.test%2F", oauth_consumer_key="my-app", oauth_token="access-token", oauth_signature_method="PLAINTEXT", oauth_signature="&access-secret", .*`)
+}
+
+func TestLaunchpadOAuthFlowNotAuthorized(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(launchpadServer{c})
+	defer srv.Close()
+	flow := LaunchpadServer{WebRoot: srv.URL + "/"}.OAuthFlow("my-app")
+	_, err := flow.AccessToken(context.Background(), &RequestToken{Token: "request-token", Secret: "wrong"}, "")
+	c.Assert(err, qt.ErrorMatches, "Request token has not yet been reviewed. Try again later.\n")
+}
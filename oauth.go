@@ -4,14 +4,20 @@
 package usso
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,9 +26,15 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
-// Create a timestamp used in authorization header.
-func timestamp() string {
-	return strconv.Itoa(int(time.Now().Unix()))
+// Create a timestamp used in authorization header. The timestamp is
+// corrected for the offset of the server's clock, if one has been
+// measured.
+func timestamp(baseURL string) string {
+	var host string
+	if u, err := url.Parse(baseURL); err == nil {
+		host = u.Host
+	}
+	return strconv.Itoa(int(DefaultClockSkew.Now(host).Unix()))
 }
 
 // Create a nonce used in authorization header.
@@ -47,6 +59,69 @@ type RequestParameters struct {
 	Nonce           string
 	Timestamp       string
 	SignatureMethod SignatureMethod
+
+	// Strict selects strict conformance with RFC 5849. When it is
+	// false the request is signed the way earlier versions of this
+	// package did, which Ubuntu SSO accepts. Strict mode percent
+	// encodes the PLAINTEXT secrets and the Authorization header
+	// values as described in section 3.6, normalizes the scheme and
+	// host of the URL to lower case, and omits the optional
+	// oauth_token, oauth_version and realm parameters when they have
+	// no value to send.
+	Strict bool
+
+	// Debug, if it is not nil, is called with the intermediate values
+	// computed when the request is signed with HMACSHA1.
+	Debug func(*SignatureDebug)
+
+	// Transmission selects how SignRequest sends the OAuth protocol
+	// parameters to the server. The default is AuthorizationHeader.
+	Transmission ParameterTransmission
+}
+
+// ParameterTransmission is a method of sending the OAuth protocol
+// parameters, see http://tools.ietf.org/html/rfc5849#section-3.5. The
+// signature is the same whichever method is used.
+type ParameterTransmission int
+
+const (
+	// AuthorizationHeader sends the parameters in the HTTP
+	// Authorization header.
+	AuthorizationHeader ParameterTransmission = iota
+
+	// FormBody appends the parameters to a form-encoded request body.
+	// The request must either have no Content-Type or have a
+	// Content-Type of application/x-www-form-urlencoded.
+	FormBody
+
+	// QueryString appends the parameters to the query string of the
+	// request URL.
+	QueryString
+)
+
+// oauthParameters returns the OAuth protocol parameters, other than
+// oauth_signature, that are sent with a request signed using rp. Any
+// parameters in rp.Params with an "oauth_" prefix, such as
+// oauth_callback and oauth_verifier, are protocol parameters and are
+// included.
+func (ssodata *SSOData) oauthParameters(rp *RequestParameters) url.Values {
+	params := url.Values{}
+	for k, v := range rp.Params {
+		if strings.HasPrefix(k, "oauth_") && k != "oauth_signature" {
+			params[k] = v
+		}
+	}
+	params.Set("oauth_consumer_key", ssodata.ConsumerKey)
+	params.Set("oauth_nonce", rp.Nonce)
+	params.Set("oauth_signature_method", rp.SignatureMethod.Name())
+	params.Set("oauth_timestamp", rp.Timestamp)
+	if !rp.Strict || ssodata.TokenKey != "" {
+		params.Set("oauth_token", ssodata.TokenKey)
+	}
+	if !rp.Strict {
+		params.Set("oauth_version", "1.0")
+	}
+	return params
 }
 
 type SignatureMethod interface {
@@ -64,12 +139,73 @@ func (PLAINTEXT) Name() string { return "PLAINTEXT" }
 // Calculate the oaut_signature part of the Authentication Header.
 func (PLAINTEXT) Signature(
 	ssodata *SSOData, rp *RequestParameters) (string, error) {
+	if rp.Strict {
+		return escape(ssodata.ConsumerSecret) + "&" + escape(ssodata.TokenSecret), nil
+	}
 	return fmt.Sprintf(
 		`%s&%s`,
 		ssodata.ConsumerSecret,
 		ssodata.TokenSecret), nil
 }
 
+// SignatureDebug holds the intermediate values computed when signing a
+// request with HMACSHA1. Comparing these with the values computed by the
+// server is usually the quickest way to find the cause of a signature
+// mismatch.
+type SignatureDebug struct {
+	// NormalizedURL holds the base string URI, see
+	// http://tools.ietf.org/html/rfc5849#section-3.4.1.2.
+	NormalizedURL string
+
+	// NormalizedParameters holds the sorted, encoded parameters, see
+	// http://tools.ietf.org/html/rfc5849#section-3.4.1.3.2.
+	NormalizedParameters []string
+
+	// BaseString holds the signature base string, see
+	// http://tools.ietf.org/html/rfc5849#section-3.4.1.
+	BaseString string
+}
+
+// signatureDebug computes the signature base string for the request.
+func signatureDebug(ssodata *SSOData, rp *RequestParameters) (*SignatureDebug, error) {
+	baseUrl, err := normalizeURL(rp.BaseURL, rp.Strict)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	for k, v := range rp.Params {
+		query[k] = v
+	}
+	for k, v := range ssodata.oauthParameters(rp) {
+		query[k] = v
+	}
+	params := normalizeParameters(query)
+	method := rp.HTTPMethod
+	if rp.Strict {
+		// See http://tools.ietf.org/html/rfc5849#section-3.4.1.1.
+		method = strings.ToUpper(method)
+	}
+	return &SignatureDebug{
+		NormalizedURL:        baseUrl,
+		NormalizedParameters: params.strings(),
+		BaseString: fmt.Sprintf("%s&%s&%s",
+			method,
+			escape(baseUrl),
+			escape(params.String()),
+		),
+	}, nil
+}
+
+// SignatureBaseString returns the signature base string that is signed
+// when the request described by rp is signed with HMACSHA1.
+func SignatureBaseString(ssodata *SSOData, rp *RequestParameters) (string, error) {
+	d, err := signatureDebug(ssodata, rp)
+	if err != nil {
+		return "", err
+	}
+	return d.BaseString, nil
+}
+
 type HMACSHA1 struct{}
 
 // Return the name of the signature method, used to compose the
@@ -79,32 +215,20 @@ func (HMACSHA1) Name() string { return "HMAC-SHA1" }
 // Calculate the oaut_signature part of the Authentication Header.
 func (HMACSHA1) Signature(
 	ssodata *SSOData, rp *RequestParameters) (string, error) {
-	baseUrl, err := NormalizeURL(rp.BaseURL)
+	d, err := signatureDebug(ssodata, rp)
 	if err != nil {
 		return "", err
 	}
-	query := url.Values{}
-	for k, v := range rp.Params {
-		query[k] = v
+	if rp.Debug != nil {
+		rp.Debug(d)
 	}
-	query.Set("oauth_consumer_key", ssodata.ConsumerKey)
-	query.Set("oauth_nonce", rp.Nonce)
-	query.Set("oauth_signature_method", string(rp.SignatureMethod.Name()))
-	query.Set("oauth_timestamp", rp.Timestamp)
-	query.Set("oauth_token", ssodata.TokenKey)
-	query.Set("oauth_version", "1.0")
-	params, err := NormalizeParameters(query)
-	if err != nil {
-		return "", err
+	key := ssodata.ConsumerSecret + "&" + ssodata.TokenSecret
+	if rp.Strict {
+		// See http://tools.ietf.org/html/rfc5849#section-3.4.2.
+		key = escape(ssodata.ConsumerSecret) + "&" + escape(ssodata.TokenSecret)
 	}
-	baseString := fmt.Sprintf("%s&%s&%s",
-		rp.HTTPMethod,
-		escape(baseUrl),
-		escape(params),
-	)
-	hashfun := hmac.New(sha1.New, []byte(
-		ssodata.ConsumerSecret+"&"+ssodata.TokenSecret))
-	hashfun.Write([]byte(baseString))
+	hashfun := hmac.New(sha1.New, []byte(key))
+	hashfun.Write([]byte(d.BaseString))
 	rawsignature := hashfun.Sum(nil)
 	base64signature := make(
 		[]byte, base64.StdEncoding.EncodedLen(len(rawsignature)))
@@ -112,19 +236,35 @@ func (HMACSHA1) Signature(
 	return string(base64signature), nil
 }
 
-// Sign the provided request.
-func (ssodata *SSOData) GetAuthorizationHeader(
-	rp *RequestParameters) (string, error) {
+// signedParameters signs the request described by rp and returns all
+// the OAuth protocol parameters, including oauth_signature.
+func (ssodata *SSOData) signedParameters(
+	rp *RequestParameters) (url.Values, error) {
 	if rp.Nonce == "" {
 		rp.Nonce = nonce()
 	}
 	if rp.Timestamp == "" {
-		rp.Timestamp = timestamp()
+		rp.Timestamp = timestamp(rp.BaseURL)
 	}
 	signature, err := rp.SignatureMethod.Signature(ssodata, rp)
+	if err != nil {
+		return nil, err
+	}
+	params := ssodata.oauthParameters(rp)
+	params.Set("oauth_signature", signature)
+	return params, nil
+}
+
+// Sign the provided request.
+func (ssodata *SSOData) GetAuthorizationHeader(
+	rp *RequestParameters) (string, error) {
+	params, err := ssodata.signedParameters(rp)
 	if err != nil {
 		return "", err
 	}
+	if rp.Strict {
+		return strictAuthorizationHeader(ssodata, params), nil
+	}
 	auth := fmt.Sprintf(
 		`OAuth realm="%s", `+
 			`oauth_consumer_key="%s", `+
@@ -138,20 +278,239 @@ func (ssodata *SSOData) GetAuthorizationHeader(
 		url.QueryEscape(ssodata.ConsumerKey),
 		url.QueryEscape(ssodata.TokenKey),
 		rp.SignatureMethod.Name(),
-		signature,
+		params.Get("oauth_signature"),
 		url.QueryEscape(rp.Timestamp),
 		url.QueryEscape(rp.Nonce))
-
+	for _, k := range extraOAuthParameters(params) {
+		auth += fmt.Sprintf(`, %s="%s"`, k, url.QueryEscape(params.Get(k)))
+	}
 	return auth, nil
 }
 
-// Sign the provided request.
+// extraOAuthParameters returns, in sorted order, the names of the
+// protocol parameters in params that do not appear in oauthHeaderOrder.
+func extraOAuthParameters(params url.Values) []string {
+	var keys []string
+	for k := range params {
+		if !contains(oauthHeaderOrder, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthHeaderOrder holds the order in which the OAuth protocol
+// parameters are written to the Authorization header.
+var oauthHeaderOrder = []string{
+	"oauth_consumer_key",
+	"oauth_token",
+	"oauth_signature_method",
+	"oauth_signature",
+	"oauth_timestamp",
+	"oauth_nonce",
+	"oauth_version",
+}
+
+// quotedStringEscaper escapes the characters that must be escaped in an
+// RFC 2616 quoted-string.
+var quotedStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// strictAuthorizationHeader creates an Authorization header as
+// described in http://tools.ietf.org/html/rfc5849#section-3.5.1.
+func strictAuthorizationHeader(ssodata *SSOData, params url.Values) string {
+	var fields []string
+	if ssodata.Realm != "" {
+		// The realm is a quoted-string as defined in RFC 2617 and is
+		// not percent encoded.
+		fields = append(fields, `realm="`+quotedStringEscaper.Replace(ssodata.Realm)+`"`)
+	}
+	for _, k := range append(oauthHeaderOrder, extraOAuthParameters(params)...) {
+		if v, ok := params[k]; ok {
+			fields = append(fields, fmt.Sprintf(`%s="%s"`, k, escape(v[0])))
+		}
+	}
+	return "OAuth " + strings.Join(fields, ", ")
+}
+
+// Sign the provided request. The OAuth parameters are sent as selected
+// by rp.Transmission, replacing any OAuth parameters from an earlier
+// signature so that a request can be signed again before it is retried.
 func (ssodata *SSOData) SignRequest(
 	rp *RequestParameters, req *http.Request) error {
+	switch rp.Transmission {
+	case FormBody:
+		return ssodata.signFormBody(rp, req)
+	case QueryString:
+		return ssodata.signQueryString(rp, req)
+	}
 	auth, error := ssodata.GetAuthorizationHeader(rp)
 	if req.Header == nil {
 		req.Header = make(map[string][]string)
 	}
-	req.Header.Add("Authorization", auth)
+	req.Header.Set("Authorization", auth)
 	return error
 }
+
+// signQueryString signs req, adding the OAuth parameters to the request
+// URL as described in
+// http://tools.ietf.org/html/rfc5849#section-3.5.3.
+func (ssodata *SSOData) signQueryString(
+	rp *RequestParameters, req *http.Request) error {
+	params, err := ssodata.signedParameters(rp)
+	if err != nil {
+		return err
+	}
+	query := removeOAuthParameters(req.URL.RawQuery)
+	if query != "" {
+		query += "&"
+	}
+	req.URL.RawQuery = query + encodeParameters(params)
+	return nil
+}
+
+// signFormBody signs req, adding the OAuth parameters to the request
+// body as described in
+// http://tools.ietf.org/html/rfc5849#section-3.5.2.
+func (ssodata *SSOData) signFormBody(
+	rp *RequestParameters, req *http.Request) error {
+	if req.Header == nil {
+		req.Header = make(map[string][]string)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || mt != formContentType {
+			return fmt.Errorf("cannot add OAuth parameters to request body with content type %q", ct)
+		}
+	}
+	params, err := ssodata.signedParameters(rp)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	body = []byte(removeOAuthParameters(string(body)))
+	if len(body) > 0 {
+		body = append(body, '&')
+	}
+	body = append(body, encodeParameters(params)...)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", formContentType)
+	return nil
+}
+
+const formContentType = "application/x-www-form-urlencoded"
+
+// removeOAuthParameters removes any OAuth protocol parameters from the
+// encoded parameters in s, leaving the others untouched.
+func removeOAuthParameters(s string) string {
+	if s == "" {
+		return s
+	}
+	var kept []string
+	for _, p := range strings.Split(s, "&") {
+		k := p
+		if i := strings.Index(p, "="); i >= 0 {
+			k = p[:i]
+		}
+		if k, err := url.QueryUnescape(k); err == nil && strings.HasPrefix(k, "oauth_") {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
+}
+
+// encodeParameters encodes params in key order, percent encoding the
+// keys and values as described in
+// http://tools.ietf.org/html/rfc5849#section-3.6.
+func encodeParameters(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ss []string
+	for _, k := range keys {
+		for _, v := range params[k] {
+			ss = append(ss, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(ss, "&")
+}
+
+// ParseAuthorizationHeader parses an OAuth Authorization header, as
+// created by GetAuthorizationHeader in either legacy or strict mode,
+// and returns the parameters it holds, including the realm.
+func ParseAuthorizationHeader(h string) (url.Values, error) {
+	if !strings.HasPrefix(h, "OAuth ") {
+		return nil, fmt.Errorf("not an OAuth Authorization header")
+	}
+	params := url.Values{}
+	s := strings.TrimPrefix(h, "OAuth ")
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Authorization header parameter %q", s)
+		}
+		k := strings.TrimSpace(s[:i])
+		s = s[i+1:]
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			// The value is a quoted-string, see RFC 2616 section 2.2.
+			var buf strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				buf.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quoted string in Authorization header")
+			}
+			v, s = buf.String(), s[i+1:]
+		} else {
+			i := strings.Index(s, ",")
+			if i < 0 {
+				i = len(s)
+			}
+			v, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+		// In legacy mode the signature is sent without being
+		// encoded, so a "+" in it is not a space.
+		unescape := url.QueryUnescape
+		if k == "oauth_signature" {
+			unescape = url.PathUnescape
+		}
+		v, err := unescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Authorization header parameter %s: %v", k, err)
+		}
+		params.Add(k, v)
+	}
+}
@@ -4,8 +4,10 @@
 package usso
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -95,3 +97,165 @@ func TestSignRequestSHA1WithParams(t *testing.T) {
 	c.Assert(authHeader, qt.Matches,
 		`.*oauth_signature="`+"a/PwZ4HMX0FptNA4KRFl1jIqlOg="+`.*`)
 }
+
+func TestSignatureBaseString(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, _ := defaults(c)
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Params = url.Values{"a": []string{"b c"}}
+	base, err := SignatureBaseString(&ssodata, &rp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(base, qt.Equals, "GET&https%3A%2F%2Flocalhost&a%3Db%2520c%26oauth_consumer_key%3DrfyzhdQ%26oauth_nonce%3D10888885%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1358853126%26oauth_token%3Dabcs%26oauth_version%3D1.0")
+}
+
+// RequestParameters.Debug is called with the values used to compute the
+// signature.
+func TestSignRequestSHA1Debug(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, req := defaults(c)
+	var debug []*SignatureDebug
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Debug = func(d *SignatureDebug) {
+		debug = append(debug, d)
+	}
+	// Signature methods can still be compared.
+	c.Assert(rp.SignatureMethod == HMACSHA1{}, qt.IsTrue)
+	err := ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(debug, qt.HasLen, 1)
+	c.Assert(debug[0].NormalizedURL, qt.Equals, "https://localhost")
+	c.Assert(debug[0].NormalizedParameters, qt.DeepEquals, []string{
+		"oauth_consumer_key=rfyzhdQ",
+		"oauth_nonce=10888885",
+		"oauth_signature_method=HMAC-SHA1",
+		"oauth_timestamp=1358853126",
+		"oauth_token=abcs",
+		"oauth_version=1.0",
+	})
+	base, err := SignatureBaseString(&ssodata, &rp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(debug[0].BaseString, qt.Equals, base)
+	c.Assert(req.Header.Get("Authorization"), qt.Matches,
+		`.*oauth_signature="`+"amJnYeek4G9ObTgTiE2y6cwTyPg="+`.*`)
+}
+
+// The OAuth parameters can be sent in the query string and produce the
+// same signature as the Authorization header.
+func TestSignRequestQueryString(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, req := defaults(c)
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Params = url.Values{"a": []string{"b c"}}
+	rp.Transmission = QueryString
+	req.URL.RawQuery = "a=b%20c"
+	err := ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(req.Header.Get("Authorization"), qt.Equals, "")
+	c.Assert(req.URL.Query(), qt.DeepEquals, url.Values{
+		"a":                      {"b c"},
+		"oauth_consumer_key":     {consumerKey},
+		"oauth_nonce":            {"10888885"},
+		"oauth_signature":        {"lc+k45PvwLhsT5k2VCvwnY1LsGE="},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"1358853126"},
+		"oauth_token":            {tokenKey},
+		"oauth_version":          {"1.0"},
+	})
+
+	_, rp, req = defaults(c)
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Params = url.Values{"a": []string{"b c"}}
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(req.Header.Get("Authorization"), qt.Matches,
+		`.*oauth_signature="lc\+k45PvwLhsT5k2VCvwnY1LsGE=".*`)
+}
+
+// The OAuth parameters can be sent in a form-encoded body.
+func TestSignRequestFormBody(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, _ := defaults(c)
+	req, err := http.NewRequest("POST", "https://localhost", strings.NewReader("a=b+c"))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rp.HTTPMethod = "POST"
+	rp.SignatureMethod = PLAINTEXT{}
+	rp.Params = url.Values{"a": []string{"b c"}}
+	rp.Transmission = FormBody
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(req.Header.Get("Authorization"), qt.Equals, "")
+	err = req.ParseForm()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(req.PostForm, qt.DeepEquals, url.Values{
+		"a":                      {"b c"},
+		"oauth_consumer_key":     {consumerKey},
+		"oauth_nonce":            {"10888885"},
+		"oauth_signature":        {consumerSecret + "&" + tokenSecret},
+		"oauth_signature_method": {"PLAINTEXT"},
+		"oauth_timestamp":        {"1358853126"},
+		"oauth_token":            {tokenKey},
+		"oauth_version":          {"1.0"},
+	})
+	body, err := req.GetBody()
+	c.Assert(err, qt.Equals, nil)
+	data, err := ioutil.ReadAll(body)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(req.ContentLength, qt.Equals, int64(len(data)))
+}
+
+// The OAuth parameters cannot be added to a body that is not form
+// encoded.
+func TestSignRequestFormBodyWrongContentType(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, _ := defaults(c)
+	req, err := http.NewRequest("POST", "https://localhost", strings.NewReader("{}"))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Transmission = FormBody
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.ErrorMatches, `cannot add OAuth parameters to request body with content type "application/json"`)
+}
+
+func TestParseAuthorizationHeader(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata := SSOData{
+		ConsumerKey:    "consumer key",
+		ConsumerSecret: "consumer+secret",
+		Realm:          `My, "Realm"`,
+		TokenKey:       "token",
+		TokenSecret:    "a+b",
+	}
+	for _, strict := range []bool{false, true} {
+		rp := RequestParameters{
+			HTTPMethod:      "GET",
+			BaseURL:         "https://localhost",
+			Params:          url.Values{"oauth_callback": {"https://example.com/cb?a=b c"}},
+			SignatureMethod: PLAINTEXT{},
+			Strict:          strict,
+		}
+		h, err := ssodata.GetAuthorizationHeader(&rp)
+		c.Assert(err, qt.IsNil)
+		params, err := ParseAuthorizationHeader(h)
+		c.Assert(err, qt.IsNil, qt.Commentf("strict %v", strict))
+		sig, err := PLAINTEXT{}.Signature(&ssodata, &rp)
+		c.Assert(err, qt.IsNil)
+		c.Check(params.Get("realm"), qt.Equals, ssodata.Realm)
+		c.Check(params.Get("oauth_consumer_key"), qt.Equals, ssodata.ConsumerKey)
+		c.Check(params.Get("oauth_signature"), qt.Equals, sig)
+		c.Check(params.Get("oauth_callback"), qt.Equals, "https://example.com/cb?a=b c")
+		c.Check(params.Get("oauth_nonce"), qt.Equals, rp.Nonce)
+	}
+
+	_, err := ParseAuthorizationHeader("Basic Zm9vOmJhcg==")
+	c.Assert(err, qt.ErrorMatches, "not an OAuth Authorization header")
+	_, err = ParseAuthorizationHeader(`OAuth realm="API`)
+	c.Assert(err, qt.ErrorMatches, "unterminated quoted string in Authorization header")
+}
@@ -0,0 +1,337 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+// Package openidtest provides an in-process OpenID 2.0 provider that
+// behaves like Ubuntu SSO, for testing login flows that use the openid
+// package without access to the network.
+//
+// The provider approves every checkid_setup request for its configured
+// identity, redirecting straight back to the return_to URL with a
+// signed positive assertion, and answers the check_authentication
+// requests made by openid.Client.Verify.
+package openidtest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/juju/usso"
+)
+
+const (
+	nsOpenID   = "http://specs.openid.net/auth/2.0"
+	nsSReg     = "http://openid.net/extensions/sreg/1.1"
+	nsTeams    = "http://ns.launchpad.net/2007/openid-teams"
+	nsMacaroon = "http://ns.login.ubuntu.com/2016/openid-macaroon"
+)
+
+// Identity holds the details of the user the provider logs in.
+type Identity struct {
+	// ID holds the identifier of the user. The claimed ID in
+	// assertions is the provider's URL followed by "/+id/" and ID.
+	ID string
+
+	// Teams holds the teams the user is a member of. Assertions
+	// include those that were queried by the relying party.
+	Teams []string
+
+	// SReg holds the simple registration fields of the user, keyed
+	// by field name. Assertions include those that were requested by
+	// the relying party.
+	SReg map[string]string
+}
+
+// Discharger creates the discharge macaroon for a third-party caveat
+// addressed to the provider.
+type Discharger func(caveatID string) (*macaroon.Macaroon, error)
+
+// Handler implements a fake OpenID provider as an http.Handler for the
+// path "/+openid", so that it can be served alongside other handlers.
+// The endpoint and claimed IDs in assertions are derived from the host
+// the request was sent to. A Handler is safe for concurrent use.
+type Handler struct {
+	key         []byte
+	assocHandle string
+
+	mu         sync.Mutex
+	identity   Identity
+	cancel     bool
+	errMessage string
+	discharger Discharger
+	checked    map[string]bool
+	nonce      int
+}
+
+// NewHandler returns a new handler that logs in the given identity.
+func NewHandler(identity Identity) *Handler {
+	return &Handler{
+		key:         randomBytes(32),
+		assocHandle: "openidtest-" + base64.RawURLEncoding.EncodeToString(randomBytes(8)),
+		identity:    identity,
+		checked:     make(map[string]bool),
+	}
+}
+
+// Provider is a fake OpenID provider listening on a local address.
+type Provider struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewProvider starts and returns a new provider that logs in the given
+// identity. The caller should call Close when finished, to shut it
+// down.
+func NewProvider(identity Identity) *Provider {
+	h := NewHandler(identity)
+	return &Provider{
+		Server:  httptest.NewServer(h),
+		Handler: h,
+	}
+}
+
+// UbuntuSSOServer returns an UbuntuSSOServer for the provider, for use
+// with openid.NewClient.
+func (p *Provider) UbuntuSSOServer() usso.UbuntuSSOServer {
+	return usso.NewUbuntuSSOServer(p.URL, "")
+}
+
+// ClaimedID returns the claimed ID asserted for the current identity.
+func (p *Provider) ClaimedID() string {
+	return p.Handler.ClaimedID(p.URL)
+}
+
+// ClaimedID returns the claimed ID asserted for the current identity
+// when the handler is served at baseURL.
+func (h *Handler) ClaimedID(baseURL string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.claimedID(baseURL)
+}
+
+// claimedID returns the claimed ID of the current identity. It must be
+// called with h.mu held.
+func (h *Handler) claimedID(baseURL string) string {
+	return baseURL + "/+id/" + h.identity.ID
+}
+
+// SetIdentity sets the identity the provider logs in.
+func (h *Handler) SetIdentity(identity Identity) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.identity = identity
+}
+
+// SetCancel sets whether the provider responds to login requests as if
+// the user had cancelled the login.
+func (h *Handler) SetCancel(cancel bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cancel = cancel
+}
+
+// SetError sets an error message the provider responds to login
+// requests with. If message is blank then logins succeed.
+func (h *Handler) SetError(message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errMessage = message
+}
+
+// SetDischarger sets the function used to discharge macaroon caveats.
+// By default the discharge macaroon has the caveat ID as its identifier,
+// the provider's URL as its location, and a random root key.
+func (h *Handler) SetDischarger(d Discharger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.discharger = d
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/+openid" {
+		http.NotFound(w, req)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch mode := req.Form.Get("openid.mode"); mode {
+	case "checkid_setup":
+		h.serveCheckIDSetup(w, req)
+	case "check_authentication":
+		h.serveCheckAuthentication(w, req)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported mode %q", mode), http.StatusBadRequest)
+	}
+}
+
+// serveCheckIDSetup serves a login request by redirecting to the
+// return_to URL with the response.
+func (h *Handler) serveCheckIDSetup(w http.ResponseWriter, req *http.Request) {
+	returnTo, err := url.Parse(req.Form.Get("openid.return_to"))
+	if err != nil || !returnTo.IsAbs() {
+		http.Error(w, "invalid openid.return_to", http.StatusBadRequest)
+		return
+	}
+	resp, err := h.response(req.Form, requestBaseURL(req))
+	if err != nil {
+		resp = url.Values{
+			"openid.ns":    {nsOpenID},
+			"openid.mode":  {"error"},
+			"openid.error": {err.Error()},
+		}
+	}
+	q := returnTo.Query()
+	for k, v := range resp {
+		q[k] = v
+	}
+	returnTo.RawQuery = q.Encode()
+	http.Redirect(w, req, returnTo.String(), http.StatusFound)
+}
+
+// response returns the response to the given login request, made to
+// the handler at baseURL.
+func (h *Handler) response(form url.Values, baseURL string) (url.Values, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel {
+		return url.Values{
+			"openid.ns":   {nsOpenID},
+			"openid.mode": {"cancel"},
+		}, nil
+	}
+	if h.errMessage != "" {
+		return nil, errgo.New(h.errMessage)
+	}
+	h.nonce++
+	v := url.Values{
+		"openid.ns":             {nsOpenID},
+		"openid.mode":           {"id_res"},
+		"openid.op_endpoint":    {baseURL + "/+openid"},
+		"openid.claimed_id":     {h.claimedID(baseURL)},
+		"openid.identity":       {h.claimedID(baseURL)},
+		"openid.return_to":      {form.Get("openid.return_to")},
+		"openid.response_nonce": {fmt.Sprintf("%s%d", time.Now().UTC().Format("2006-01-02T15:04:05Z"), h.nonce)},
+		"openid.assoc_handle":   {h.assocHandle},
+	}
+	if teams := form.Get("openid.lp.query_membership"); teams != "" {
+		v.Set("openid.ns.lp", nsTeams)
+		if member := intersect(strings.Split(teams, ","), h.identity.Teams); len(member) > 0 {
+			v.Set("openid.lp.is_member", strings.Join(member, ","))
+		}
+	}
+	var sreg []string
+	for _, k := range []string{"openid.sreg.required", "openid.sreg.optional"} {
+		if fields := form.Get(k); fields != "" {
+			sreg = append(sreg, strings.Split(fields, ",")...)
+		}
+	}
+	if len(sreg) > 0 {
+		v.Set("openid.ns.sreg", nsSReg)
+		for _, f := range sreg {
+			if value, ok := h.identity.SReg[f]; ok {
+				v.Set("openid.sreg."+f, value)
+			}
+		}
+	}
+	if caveatID := form.Get("openid.macaroon.caveat_id"); caveatID != "" {
+		discharger := h.discharger
+		if discharger == nil {
+			discharger = func(caveatID string) (*macaroon.Macaroon, error) {
+				return macaroon.New(randomBytes(24), []byte(caveatID), baseURL, macaroon.LatestVersion)
+			}
+		}
+		m, err := discharger(caveatID)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot discharge caveat")
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v.Set("openid.ns.macaroon", nsMacaroon)
+		v.Set("openid.macaroon.discharge", base64.RawURLEncoding.EncodeToString(data))
+	}
+	var signed []string
+	for k := range v {
+		if k != "openid.mode" && k != "openid.ns" {
+			signed = append(signed, strings.TrimPrefix(k, "openid."))
+		}
+	}
+	sort.Strings(signed)
+	v.Set("openid.signed", strings.Join(signed, ","))
+	v.Set("openid.sig", h.signature(v))
+	return v, nil
+}
+
+// serveCheckAuthentication serves a request to verify an assertion.
+// Each assertion can be verified only once.
+func (h *Handler) serveCheckAuthentication(w http.ResponseWriter, req *http.Request) {
+	valid := req.Form.Get("openid.assoc_handle") == h.assocHandle &&
+		hmac.Equal([]byte(req.Form.Get("openid.sig")), []byte(h.signature(req.Form)))
+	if valid {
+		nonce := req.Form.Get("openid.response_nonce")
+		h.mu.Lock()
+		valid = !h.checked[nonce]
+		h.checked[nonce] = true
+		h.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "ns:%s\nis_valid:%t\n", nsOpenID, valid)
+}
+
+// signature returns the signature of the fields listed in
+// openid.signed, as described in
+// http://openid.net/specs/openid-authentication-2_0.html#rfc.section.6.
+func (h *Handler) signature(v url.Values) string {
+	mac := hmac.New(sha256.New, h.key)
+	for _, k := range strings.Split(v.Get("openid.signed"), ",") {
+		fmt.Fprintf(mac, "%s:%s\n", k, v.Get("openid."+k))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestBaseURL returns the scheme and host that req was sent to.
+func requestBaseURL(req *http.Request) string {
+	if req.TLS != nil {
+		return "https://" + req.Host
+	}
+	return "http://" + req.Host
+}
+
+// intersect returns the elements of ss that are also in ts.
+func intersect(ss, ts []string) []string {
+	var r []string
+	for _, s := range ss {
+		for _, t := range ts {
+			if s == t {
+				r = append(r, s)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// randomBytes returns n random bytes.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package openidtest_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/juju/usso/openid"
+	"github.com/juju/usso/openid/openidtest"
+)
+
+// login performs a complete login against p, following the redirects
+// from the login URL to a callback server, which verifies the response.
+func login(c *qt.C, p *openidtest.Provider, r openid.Request) (*openid.Response, error) {
+	client := openid.NewClient(p.UbuntuSSOServer(), nil, nil)
+	var resp *openid.Response
+	var verifyErr error
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp, verifyErr = client.Verify("http://" + req.Host + req.URL.RequestURI())
+	}))
+	defer callback.Close()
+	r.ReturnTo = callback.URL + "/callback?state=1234"
+	httpResp, err := http.Get(client.RedirectURL(&r))
+	c.Assert(err, qt.IsNil)
+	httpResp.Body.Close()
+	c.Assert(httpResp.StatusCode, qt.Equals, http.StatusOK)
+	return resp, verifyErr
+}
+
+func TestLogin(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{
+		ID:    "abcdefg",
+		Teams: []string{"team1", "team3"},
+		SReg: map[string]string{
+			openid.SRegEmail:    "foo@example.com",
+			openid.SRegNickname: "foo",
+			openid.SRegFullName: "Foo Bar",
+		},
+	})
+	defer p.Close()
+	resp, err := login(c, p, openid.Request{
+		Teams:        []string{"team1", "team2", "team3"},
+		SRegRequired: []string{openid.SRegEmail},
+		SRegOptional: []string{openid.SRegNickname, openid.SRegCity},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &openid.Response{
+		ID:    p.URL + "/+id/abcdefg",
+		Teams: []string{"team1", "team3"},
+		SReg: map[string]string{
+			openid.SRegEmail:    "foo@example.com",
+			openid.SRegNickname: "foo",
+		},
+	})
+	c.Assert(p.ClaimedID(), qt.Equals, resp.ID)
+}
+
+func TestLoginNoTeams(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{ID: "abcdefg"})
+	defer p.Close()
+	resp, err := login(c, p, openid.Request{
+		Teams: []string{"team1"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Teams, qt.IsNil)
+}
+
+func TestLoginDischarge(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{ID: "abcdefg"})
+	defer p.Close()
+	resp, err := login(c, p, openid.Request{
+		CaveatID: "my-caveat",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Discharge, qt.Not(qt.IsNil))
+	c.Assert(string(resp.Discharge.Id()), qt.Equals, "my-caveat")
+	c.Assert(resp.Discharge.Location(), qt.Equals, p.URL)
+
+	p.SetDischarger(func(caveatID string) (*macaroon.Macaroon, error) {
+		return macaroon.New([]byte("root key"), []byte("custom-"+caveatID), "here", macaroon.LatestVersion)
+	})
+	resp, err = login(c, p, openid.Request{
+		CaveatID: "my-caveat",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(resp.Discharge.Id()), qt.Equals, "custom-my-caveat")
+
+	p.SetDischarger(func(caveatID string) (*macaroon.Macaroon, error) {
+		return nil, errors.New("no")
+	})
+	_, err = login(c, p, openid.Request{
+		CaveatID: "my-caveat",
+	})
+	c.Assert(err, qt.ErrorMatches, "cannot discharge caveat: no")
+}
+
+func TestLoginCancel(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{ID: "abcdefg"})
+	defer p.Close()
+	p.SetCancel(true)
+	_, err := login(c, p, openid.Request{})
+	c.Assert(errgo.Cause(err), qt.Equals, openid.ErrCancel)
+}
+
+func TestLoginError(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{ID: "abcdefg"})
+	defer p.Close()
+	p.SetError("something went wrong")
+	_, err := login(c, p, openid.Request{})
+	c.Assert(err, qt.ErrorMatches, "something went wrong")
+	c.Assert(err, qt.Satisfies, func(err error) bool {
+		_, ok := err.(*openid.OpenIDError)
+		return ok
+	})
+
+	p.SetError("")
+	_, err = login(c, p, openid.Request{})
+	c.Assert(err, qt.IsNil)
+}
+
+func TestVerifyReplay(t *testing.T) {
+	c := qt.New(t)
+
+	p := openidtest.NewProvider(openidtest.Identity{ID: "abcdefg"})
+	defer p.Close()
+	var callbackURL string
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		callbackURL = "http://" + req.Host + req.URL.RequestURI()
+	}))
+	defer callback.Close()
+	client := openid.NewClient(p.UbuntuSSOServer(), nil, nil)
+	resp, err := http.Get(client.RedirectURL(&openid.Request{ReturnTo: callback.URL + "/callback"}))
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+
+	_, err = client.Verify(callbackURL)
+	c.Assert(err, qt.IsNil)
+	// A new client, with a new nonce store, still cannot use the
+	// same assertion because the provider only verifies it once.
+	client = openid.NewClient(p.UbuntuSSOServer(), nil, nil)
+	_, err = client.Verify(callbackURL)
+	c.Assert(err, qt.ErrorMatches, "Could not verify assertion with provider")
+}
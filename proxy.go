@@ -0,0 +1,289 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SigningProxy is an http.Handler that forwards requests to upstream
+// servers, signing each one with SSOData, so that programs that cannot
+// sign OAuth requests themselves can use services that require them.
+//
+// If Upstream is set the proxy acts as a reverse proxy, forwarding
+// every request to the same server. Otherwise it acts as a forward
+// proxy, for use by clients configured with the HTTP_PROXY environment
+// variable, and forwards each request to the absolute URL it was sent
+// with. A forward proxy cannot sign requests tunnelled with CONNECT, so
+// clients must send plain HTTP requests to it.
+//
+// Requests are only signed when they are sent to a host in
+// AllowedHosts, or to the host of Upstream, so that the credentials are
+// never sent to a server the caller did not choose. As a PLAINTEXT
+// signature holds the secrets themselves, requests that would be
+// signed with PLAINTEXT are refused unless they are sent upstream over
+// https, which for a forward proxy is never the case.
+//
+// SigningProxy does not authenticate its clients: any client that can
+// send requests to it can make signed requests to the allowed hosts
+// with the credentials in SSOData. It should only be served on a
+// loopback address, or behind a handler that authenticates clients.
+type SigningProxy struct {
+	// SSOData holds the credentials used to sign requests.
+	SSOData *SSOData
+
+	// Upstream holds the URL of the server requests are forwarded
+	// to by a reverse proxy. The path of each request is appended to
+	// the path of Upstream. If Upstream is nil the proxy is a forward
+	// proxy.
+	Upstream *url.URL
+
+	// AllowedHosts holds the hosts that signed requests may be sent
+	// to. An entry without a port matches the host on any port, and
+	// an entry of the form "*.example.com" matches any subdomain of
+	// example.com. The host of Upstream is always allowed.
+	AllowedHosts []string
+
+	// ForwardUnlisted causes requests to hosts that are not allowed
+	// to be forwarded without a signature. Otherwise they are
+	// refused with the status 403 (Forbidden).
+	ForwardUnlisted bool
+
+	// SignatureMethod holds the method used to sign requests. If it
+	// is nil then HMACSHA1 is used.
+	SignatureMethod SignatureMethod
+
+	// Strict selects strict conformance with RFC 5849 when signing,
+	// see RequestParameters.Strict.
+	Strict bool
+
+	// Transport holds the transport used to send requests upstream.
+	// If it is nil then http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Log, if it is not nil, is called after every request.
+	Log func(*ProxyLogEntry)
+}
+
+// ProxyLogEntry describes a request handled by a SigningProxy.
+type ProxyLogEntry struct {
+	// Method holds the method of the request.
+	Method string
+
+	// URL holds the upstream URL the request was forwarded to, or
+	// the requested URL if it was refused.
+	URL string
+
+	// Signed reports whether the request was signed.
+	Signed bool
+
+	// StatusCode holds the status of the response sent to the
+	// client.
+	StatusCode int
+
+	// Duration holds the time taken to handle the request.
+	Duration time.Duration
+
+	// Err holds the error that caused the request to fail, if any.
+	Err error
+}
+
+// ServeHTTP implements http.Handler.
+func (p *SigningProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	entry := &ProxyLogEntry{
+		Method: req.Method,
+	}
+	lw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	p.serve(lw, req, entry)
+	if p.Log != nil {
+		entry.StatusCode = lw.status
+		entry.Duration = time.Since(start)
+		p.Log(entry)
+	}
+}
+
+// serve serves req, recording what was done in entry.
+func (p *SigningProxy) serve(w http.ResponseWriter, req *http.Request, entry *ProxyLogEntry) {
+	if req.Method == "CONNECT" {
+		entry.URL = req.Host
+		http.Error(w, "CONNECT is not supported: requests must be sent to the proxy unencrypted to be signed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := p.target(req.URL)
+	if target == nil {
+		entry.URL = req.URL.String()
+		http.Error(w, "not a proxy request: the request URL must be absolute", http.StatusBadRequest)
+		return
+	}
+	entry.URL = target.String()
+	entry.Signed = p.allowed(target)
+	if !entry.Signed && !p.ForwardUnlisted {
+		http.Error(w, "host "+target.Host+" is not allowed", http.StatusForbidden)
+		return
+	}
+	if entry.Signed && target.Scheme != "https" && p.SignatureMethod != nil && p.SignatureMethod.Name() == (PLAINTEXT{}).Name() {
+		http.Error(w, "refusing to send PLAINTEXT signature to "+target.Host+" without https", http.StatusForbidden)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL = target
+			out.Host = ""
+			out.Header.Del("Proxy-Authorization")
+			if entry.Signed {
+				// Any credentials sent by the client are replaced.
+				out.Header.Del("Authorization")
+			}
+		},
+		Transport: &signingTransport{
+			proxy:  p,
+			signed: entry.Signed,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			entry.Err = err
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, req)
+}
+
+// target returns the upstream URL that a request for u is forwarded to,
+// or nil if a forward proxy is sent a request without an absolute URL.
+func (p *SigningProxy) target(u *url.URL) *url.URL {
+	if p.Upstream == nil {
+		if !u.IsAbs() || u.Host == "" {
+			return nil
+		}
+		u1 := *u
+		return &u1
+	}
+	u1 := *p.Upstream
+	u1.Path = strings.TrimSuffix(p.Upstream.Path, "/") + u.Path
+	if p.Upstream.RawPath != "" || u.RawPath != "" {
+		u1.RawPath = strings.TrimSuffix(p.Upstream.EscapedPath(), "/") + u.EscapedPath()
+	}
+	u1.RawQuery = u.RawQuery
+	return &u1
+}
+
+// allowed reports whether requests to u may be signed.
+func (p *SigningProxy) allowed(u *url.URL) bool {
+	if p.Upstream != nil && strings.EqualFold(u.Host, p.Upstream.Host) {
+		return true
+	}
+	host := u.Hostname()
+	for _, a := range p.AllowedHosts {
+		a = strings.ToLower(a)
+		if _, _, err := net.SplitHostPort(a); err == nil {
+			if strings.EqualFold(u.Host, a) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(a, "*.") {
+			if strings.HasSuffix(strings.ToLower(host), a[1:]) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(host, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// signingTransport is the transport used by a SigningProxy. It signs
+// requests that are to be signed before sending them.
+type signingTransport struct {
+	proxy  *SigningProxy
+	signed bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.proxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if !t.signed {
+		return transport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if err := bufferFormBody(req); err != nil {
+		return nil, err
+	}
+	sm := t.proxy.SignatureMethod
+	if sm == nil {
+		sm = HMACSHA1{}
+	}
+	rp, err := requestParameters(req, &RequestParameters{
+		SignatureMethod: sm,
+		Strict:          t.proxy.Strict,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := t.proxy.SSOData.SignRequest(rp, req); err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		DefaultClockSkew.Observe(resp)
+	}
+	return resp, err
+}
+
+// bufferFormBody reads the body of req into memory if it is form
+// encoded, so that its parameters can be included in the signature.
+func bufferFormBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != formContentType {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// statusWriter is an http.ResponseWriter that records the status of the
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, so that streamed responses are passed
+// on as they arrive.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var proxySSOData = &SSOData{
+	ConsumerKey:    "consumer-key",
+	ConsumerSecret: "consumer-secret",
+	Realm:          "API",
+	TokenKey:       "token-key",
+	TokenName:      "token-name",
+	TokenSecret:    "token-secret",
+}
+
+// upstreamRequest holds a request received by an upstreamHandler.
+type upstreamRequest struct {
+	req  *http.Request
+	body string
+}
+
+// upstreamHandler is an http.Handler that records the requests it
+// receives.
+type upstreamHandler struct {
+	requests []upstreamRequest
+}
+
+// ServeHTTP implements http.Handler.
+func (h *upstreamHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	h.requests = append(h.requests, upstreamRequest{req: req, body: string(body)})
+	w.Write([]byte("upstream response"))
+}
+
+// checkProxySignature checks that r was signed with proxySSOData using
+// HMAC-SHA1, including the parameters of a form encoded body.
+func checkProxySignature(c *qt.C, r upstreamRequest) {
+	headers := r.req.Header["Authorization"]
+	c.Assert(headers, qt.HasLen, 1)
+	oauth := parseAuthorizationHeader(c, headers[0])
+	c.Assert(oauth["oauth_consumer_key"], qt.Equals, proxySSOData.ConsumerKey)
+	c.Assert(oauth["oauth_token"], qt.Equals, proxySSOData.TokenKey)
+	params := r.req.URL.Query()
+	if r.req.Header.Get("Content-Type") == formContentType {
+		form, err := url.ParseQuery(r.body)
+		c.Assert(err, qt.IsNil)
+		addParameters(params, form)
+	}
+	u := *r.req.URL
+	u.Scheme = "http"
+	u.Host = r.req.Host
+	rp := RequestParameters{
+		HTTPMethod:      r.req.Method,
+		BaseURL:         u.String(),
+		Params:          params,
+		Nonce:           oauth["oauth_nonce"],
+		Timestamp:       oauth["oauth_timestamp"],
+		SignatureMethod: HMACSHA1{},
+	}
+	sig, err := rp.SignatureMethod.Signature(proxySSOData, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(oauth["oauth_signature"], qt.Equals, sig)
+}
+
+func TestSigningProxyReverse(t *testing.T) {
+	c := qt.New(t)
+
+	h := &upstreamHandler{}
+	upstream := httptest.NewServer(h)
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL + "/base/")
+	c.Assert(err, qt.IsNil)
+	var entries []*ProxyLogEntry
+	proxy := httptest.NewServer(&SigningProxy{
+		SSOData:  proxySSOData,
+		Upstream: upstreamURL,
+		Log: func(e *ProxyLogEntry) {
+			entries = append(entries, e)
+		},
+	})
+	defer proxy.Close()
+
+	req, err := http.NewRequest("POST", proxy.URL+"/api/x?a=b", strings.NewReader("c=d+e"))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", formContentType)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(string(body), qt.Equals, "upstream response")
+
+	c.Assert(h.requests, qt.HasLen, 1)
+	r := h.requests[0]
+	c.Assert(r.req.URL.Path, qt.Equals, "/base/api/x")
+	c.Assert(r.req.URL.RawQuery, qt.Equals, "a=b")
+	c.Assert(r.req.Host, qt.Equals, upstreamURL.Host)
+	c.Assert(r.body, qt.Equals, "c=d+e")
+	checkProxySignature(c, r)
+
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Method, qt.Equals, "POST")
+	c.Assert(entries[0].URL, qt.Equals, upstream.URL+"/base/api/x?a=b")
+	c.Assert(entries[0].Signed, qt.IsTrue)
+	c.Assert(entries[0].StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(entries[0].Err, qt.IsNil)
+}
+
+func TestSigningProxyForward(t *testing.T) {
+	c := qt.New(t)
+
+	h := &upstreamHandler{}
+	upstream := httptest.NewServer(h)
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	c.Assert(err, qt.IsNil)
+	// The upstream server can also be reached as localhost, which is
+	// not allowed.
+	unlisted := "http://localhost:" + upstreamURL.Port()
+	var entries []*ProxyLogEntry
+	sp := &SigningProxy{
+		SSOData:      proxySSOData,
+		AllowedHosts: []string{upstreamURL.Hostname()},
+		Log: func(e *ProxyLogEntry) {
+			entries = append(entries, e)
+		},
+	}
+	proxy := httptest.NewServer(sp)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+	}
+
+	resp, err := client.Get(upstream.URL + "/path?x=y")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(h.requests, qt.HasLen, 1)
+	checkProxySignature(c, h.requests[0])
+
+	resp, err = client.Get(unlisted + "/path")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+	c.Assert(h.requests, qt.HasLen, 1)
+
+	sp.ForwardUnlisted = true
+	resp, err = client.Get(unlisted + "/path")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(h.requests, qt.HasLen, 2)
+	c.Assert(h.requests[1].req.Header.Get("Authorization"), qt.Equals, "")
+
+	c.Assert(entries, qt.HasLen, 3)
+	for i, expect := range []struct {
+		url    string
+		signed bool
+		status int
+	}{
+		{upstream.URL + "/path?x=y", true, http.StatusOK},
+		{unlisted + "/path", false, http.StatusForbidden},
+		{unlisted + "/path", false, http.StatusOK},
+	} {
+		c.Check(entries[i].URL, qt.Equals, expect.url)
+		c.Check(entries[i].Signed, qt.Equals, expect.signed)
+		c.Check(entries[i].StatusCode, qt.Equals, expect.status)
+	}
+
+	// Requests that are not proxy requests are refused.
+	resp, err = http.Get(proxy.URL + "/path")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+
+	req, err := http.NewRequest("CONNECT", proxy.URL, nil)
+	c.Assert(err, qt.IsNil)
+	req.Host = "example.com:443"
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusMethodNotAllowed)
+}
+
+func TestSigningProxyPlaintext(t *testing.T) {
+	c := qt.New(t)
+
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		c.Check(req.Header.Get("Authorization"), qt.Matches, `OAuth .*oauth_signature_method="PLAINTEXT".*`)
+	})
+	insecure := httptest.NewServer(handler)
+	defer insecure.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	for _, upstream := range []*httptest.Server{insecure, secure} {
+		upstreamURL, err := url.Parse(upstream.URL)
+		c.Assert(err, qt.IsNil)
+		proxy := httptest.NewServer(&SigningProxy{
+			SSOData:         proxySSOData,
+			Upstream:        upstreamURL,
+			SignatureMethod: PLAINTEXT{},
+			Transport:       secure.Client().Transport,
+		})
+		resp, err := http.Get(proxy.URL + "/path")
+		proxy.Close()
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		if upstream == insecure {
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+			c.Assert(requests, qt.Equals, 0)
+		} else {
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+			c.Assert(requests, qt.Equals, 1)
+		}
+	}
+}
+
+func TestSigningProxyUpstreamError(t *testing.T) {
+	c := qt.New(t)
+
+	upstream := httptest.NewServer(&upstreamHandler{})
+	upstreamURL, err := url.Parse(upstream.URL)
+	c.Assert(err, qt.IsNil)
+	upstream.Close()
+	var entry *ProxyLogEntry
+	proxy := httptest.NewServer(&SigningProxy{
+		SSOData:  proxySSOData,
+		Upstream: upstreamURL,
+		Log: func(e *ProxyLogEntry) {
+			entry = e
+		},
+	})
+	defer proxy.Close()
+	resp, err := http.Get(proxy.URL)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadGateway)
+	c.Assert(entry.Signed, qt.IsTrue)
+	c.Assert(entry.StatusCode, qt.Equals, http.StatusBadGateway)
+	c.Assert(entry.Err, qt.Not(qt.IsNil))
+}
+
+var proxyAllowedTests = []struct {
+	url    string
+	expect bool
+}{
+	{"https://api.example.com/x", true},
+	{"https://API.Example.com:8443/x", true},
+	{"https://other.example.com/x", false},
+	{"https://example.com/x", false},
+	{"https://a.b.staging.example.com/x", true},
+	{"https://staging.example.com/x", false},
+	{"https://evilstaging.example.com/x", false},
+	{"http://localhost:8080/x", true},
+	{"http://localhost:8081/x", false},
+	{"http://upstream.example.com/x", true},
+	{"http://upstream.example.com:81/x", false},
+}
+
+func TestSigningProxyAllowed(t *testing.T) {
+	c := qt.New(t)
+
+	p := &SigningProxy{
+		Upstream:     &url.URL{Scheme: "http", Host: "upstream.example.com"},
+		AllowedHosts: []string{"api.example.com", "*.staging.example.com", "localhost:8080"},
+	}
+	for _, test := range proxyAllowedTests {
+		u, err := url.Parse(test.url)
+		c.Assert(err, qt.IsNil)
+		c.Check(p.allowed(u), qt.Equals, test.expect, qt.Commentf("%s", test.url))
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxRedirects is the number of redirects followed by the policy
+// returned from CheckRedirect, this matches the default http.Client
+// policy.
+const maxRedirects = 10
+
+// CheckRedirect returns a function suitable for use as the
+// CheckRedirect field of an http.Client that is used to send requests
+// signed with ssodata. Each redirected request is signed again for its
+// new URL, using the signature method, transmission and strictness
+// given in rp. Redirects to a host other than the one the original
+// request was sent to are refused so that the credentials are never
+// sent to a server that the caller did not choose, as are redirects
+// from https to http, which would send the request in clear.
+func (ssodata *SSOData) CheckRedirect(rp *RequestParameters) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after 10 redirects")
+		}
+		if len(via) > 0 && !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			return fmt.Errorf("refusing to follow redirect from %q to %q: signed requests may not be redirected to a different host", via[0].URL.Host, req.URL.Host)
+		}
+		if len(via) > 0 && via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing to follow redirect from %q to %q: signed requests may not be redirected to an insecure URL", via[0].URL, req.URL)
+		}
+		rp1, err := requestParameters(req, rp)
+		if err != nil {
+			return err
+		}
+		return ssodata.SignRequest(rp1, req)
+	}
+}
+
+// requestParameters creates the RequestParameters for signing req. The
+// parameters are taken from the request URL and, if present, a
+// form-encoded request body. Application protocol parameters, such as
+// oauth_callback and oauth_verifier, are also taken from the
+// Authorization header. The parameters generated when signing are
+// ignored so that they are replaced by the new signature. The signature
+// method, transmission and strictness are copied from rp.
+func requestParameters(req *http.Request, rp *RequestParameters) (*RequestParameters, error) {
+	params := url.Values{}
+	addParameters(params, authorizationParameters(req.Header.Get("Authorization")))
+	addParameters(params, req.URL.Query())
+	if req.GetBody != nil && req.Header.Get("Content-Type") != "" {
+		if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == formContentType {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return nil, err
+			}
+			form, err := url.ParseQuery(string(data))
+			if err != nil {
+				return nil, err
+			}
+			addParameters(params, form)
+		}
+	}
+	return &RequestParameters{
+		HTTPMethod:      req.Method,
+		BaseURL:         req.URL.String(),
+		Params:          params,
+		SignatureMethod: rp.SignatureMethod,
+		Strict:          rp.Strict,
+		Transmission:    rp.Transmission,
+	}, nil
+}
+
+// addParameters adds the parameters from src to dst, except those
+// generated when a request is signed.
+func addParameters(dst, src url.Values) {
+	for k, vs := range src {
+		if contains(oauthHeaderOrder, k) {
+			continue
+		}
+		dst[k] = append(dst[k], vs...)
+	}
+}
+
+// authorizationParameters returns the protocol parameters in the OAuth
+// Authorization header h, or nothing if it cannot be parsed.
+func authorizationParameters(h string) url.Values {
+	params, err := ParseAuthorizationHeader(h)
+	if err != nil {
+		return nil
+	}
+	params.Del("realm")
+	return params
+}
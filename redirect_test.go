@@ -0,0 +1,206 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// parseAuthorizationHeader parses an Authorization header created by
+// GetAuthorizationHeader.
+func parseAuthorizationHeader(c *qt.C, h string) map[string]string {
+	values, err := ParseAuthorizationHeader(h)
+	c.Assert(err, qt.IsNil)
+	params := make(map[string]string)
+	for k, v := range values {
+		params[k] = v[0]
+	}
+	return params
+}
+
+// checkSignature checks that req carries a valid HMAC-SHA1 signature
+// for its method and URL.
+func checkSignature(c *qt.C, ssodata *SSOData, req *http.Request) {
+	headers := req.Header["Authorization"]
+	c.Assert(headers, qt.HasLen, 1)
+	params := parseAuthorizationHeader(c, headers[0])
+	u := *req.URL
+	u.Scheme = "http"
+	u.Host = req.Host
+	query := req.URL.Query()
+	for k, v := range params {
+		if k != "realm" && !contains(oauthHeaderOrder, k) {
+			query.Set(k, v)
+		}
+	}
+	rp := RequestParameters{
+		HTTPMethod:      req.Method,
+		BaseURL:         u.String(),
+		Params:          query,
+		Nonce:           params["oauth_nonce"],
+		Timestamp:       params["oauth_timestamp"],
+		SignatureMethod: HMACSHA1{},
+	}
+	sig, err := rp.SignatureMethod.Signature(ssodata, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(params["oauth_signature"], qt.Equals, sig)
+}
+
+// Signing a request again replaces the previous signature.
+func TestSignRequestReplacesSignature(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, rp, req := defaults(c)
+	rp.SignatureMethod = HMACSHA1{}
+	err := ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	rp.Nonce = "12345"
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(req.Header["Authorization"], qt.HasLen, 1)
+	c.Assert(req.Header.Get("Authorization"), qt.Matches, `.*oauth_nonce="12345".*`)
+
+	_, rp, req = defaults(c)
+	rp.SignatureMethod = HMACSHA1{}
+	rp.Transmission = QueryString
+	req.URL.RawQuery = "a=1"
+	rp.Params = url.Values{"a": {"1"}}
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	rp.Nonce = "12345"
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	query := req.URL.Query()
+	c.Assert(query["a"], qt.DeepEquals, []string{"1"})
+	c.Assert(query["oauth_nonce"], qt.DeepEquals, []string{"12345"})
+	c.Assert(query["oauth_signature"], qt.HasLen, 1)
+}
+
+func TestCheckRedirectResignsRequest(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, _, _ := defaults(c)
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req)
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new?x=y", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rp := RequestParameters{
+		HTTPMethod:      "GET",
+		BaseURL:         srv.URL + "/old",
+		SignatureMethod: HMACSHA1{},
+	}
+	req, err := http.NewRequest(rp.HTTPMethod, rp.BaseURL, nil)
+	c.Assert(err, qt.IsNil)
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		CheckRedirect: ssodata.CheckRedirect(&rp),
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(requests, qt.HasLen, 2)
+	c.Assert(requests[1].URL.Path, qt.Equals, "/new")
+	checkSignature(c, &ssodata, requests[0])
+	checkSignature(c, &ssodata, requests[1])
+	c.Assert(requests[1].Header.Get("Authorization"), qt.Not(qt.Equals), requests[0].Header.Get("Authorization"))
+}
+
+func TestCheckRedirectRefusesOtherHost(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, _, _ := defaults(c)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Errorf("unexpected request to other host")
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, other.URL+"/steal", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	rp := RequestParameters{
+		HTTPMethod:      "GET",
+		BaseURL:         srv.URL,
+		SignatureMethod: HMACSHA1{},
+	}
+	req, err := http.NewRequest(rp.HTTPMethod, rp.BaseURL, nil)
+	c.Assert(err, qt.IsNil)
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		CheckRedirect: ssodata.CheckRedirect(&rp),
+	}
+	_, err = client.Do(req)
+	c.Assert(err, qt.ErrorMatches, `Get "http://.*/steal": refusing to follow redirect from ".*" to ".*": signed requests may not be redirected to a different host`)
+}
+
+func TestCheckRedirectKeepsApplicationParameters(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, _, _ := defaults(c)
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req)
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rp := RequestParameters{
+		HTTPMethod: "GET",
+		BaseURL:    srv.URL + "/old",
+		Params: url.Values{
+			"oauth_verifier": {"verifier"},
+		},
+		SignatureMethod: HMACSHA1{},
+	}
+	req, err := http.NewRequest(rp.HTTPMethod, rp.BaseURL, nil)
+	c.Assert(err, qt.IsNil)
+	err = ssodata.SignRequest(&rp, req)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		CheckRedirect: ssodata.CheckRedirect(&rp),
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(requests, qt.HasLen, 2)
+	params := parseAuthorizationHeader(c, requests[1].Header.Get("Authorization"))
+	c.Assert(params["oauth_verifier"], qt.Equals, "verifier")
+	checkSignature(c, &ssodata, requests[1])
+}
+
+func TestCheckRedirectRefusesDowngrade(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata, _, _ := defaults(c)
+	rp := RequestParameters{
+		HTTPMethod:      "GET",
+		SignatureMethod: PLAINTEXT{},
+	}
+	via, err := http.NewRequest("GET", "https://example.com/old", nil)
+	c.Assert(err, qt.IsNil)
+	req, err := http.NewRequest("GET", "http://example.com/new", nil)
+	c.Assert(err, qt.IsNil)
+	err = ssodata.CheckRedirect(&rp)(req, []*http.Request{via})
+	c.Assert(err, qt.ErrorMatches, `refusing to follow redirect from "https://example.com/old" to "http://example.com/new": signed requests may not be redirected to an insecure URL`)
+	c.Assert(req.Header.Get("Authorization"), qt.Equals, "")
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests to an Ubuntu SSO server are retried
+// after a transient failure. Requests are retried when they fail with a
+// network error or the server responds with one of the status codes 429
+// (Too Many Requests), 502 (Bad Gateway), 503 (Service Unavailable) or
+// 504 (Gateway Timeout). Requests that create new tokens are not
+// idempotent and are only retried if RetryNonIdempotent is set.
+type RetryPolicy struct {
+	// MaxAttempts holds the maximum number of attempts made for each
+	// request, including the first. A value less than 1 is treated
+	// as 1.
+	MaxAttempts int
+
+	// MinDelay holds the delay before the first retry. The delay is
+	// doubled for each subsequent retry, up to MaxDelay. The actual
+	// delay is chosen at random between half the calculated delay
+	// and the calculated delay, so that many clients do not retry in
+	// step.
+	MinDelay time.Duration
+
+	// MaxDelay holds the maximum delay between attempts. If it is zero
+	// the delay is not limited. If the server asks for a longer delay
+	// with a Retry-After header the request is not retried.
+	MaxDelay time.Duration
+
+	// RetryNonIdempotent allows requests that are not idempotent,
+	// such as token creation, to be retried. Retrying such a request
+	// can create more than one token.
+	RetryNonIdempotent bool
+
+	// Hook, if it is not nil, is called after every attempt.
+	Hook func(*Attempt)
+}
+
+// Attempt describes a single attempt at sending a request.
+type Attempt struct {
+	// Number holds the number of the attempt, starting at 1.
+	Number int
+
+	// Request holds the request that was sent.
+	Request *http.Request
+
+	// Response holds the response that was received, if any. The hook
+	// must not read or close the response body.
+	Response *http.Response
+
+	// Err holds the error returned when sending the request, if any.
+	Err error
+
+	// Retry reports whether the request will be attempted again.
+	Retry bool
+
+	// Delay holds the time that will be waited before the request is
+	// attempted again.
+	Delay time.Duration
+}
+
+// DefaultRetryPolicy is a retry policy suitable for most uses of the
+// Ubuntu SSO API.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 4,
+	MinDelay:    500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// retryable reports whether the given result of an attempt might
+// succeed if the request was sent again. Only network errors and
+// responses that end unexpectedly are retried: other errors, such as
+// an unsupported URL scheme, a TLS certificate that cannot be verified
+// or a redirect refused by the redirect policy, will not change on a
+// retry.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		// Every error returned by the client is a *url.Error, which
+		// itself implements net.Error, so check the error it wraps.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		var nerr net.Error
+		return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// delay calculates the delay before the given retry.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	d := p.MinDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the delay requested by the Retry-After header of
+// resp, if any.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		d := t.Sub(now())
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// client returns the HTTP client to use for requests to the server. If
+// checkRedirect is not nil it is used unless the server's client has
+// its own redirect policy.
+func (server UbuntuSSOServer) client(checkRedirect func(*http.Request, []*http.Request) error) *http.Client {
+	client := http.DefaultClient
+	if server.Client != nil {
+		client = server.Client
+	}
+	if checkRedirect == nil || client.CheckRedirect != nil {
+		return client
+	}
+	c := *client
+	c.CheckRedirect = checkRedirect
+	return &c
+}
+
+// send sends a request to the server, retrying according to the
+// server's retry policy. The request is created by calling newRequest,
+// which is called again for every attempt so that signed requests have
+// a fresh nonce and timestamp. Idempotent reports whether the request
+// can safely be sent more than once.
+func (server UbuntuSSOServer) send(
+	ctx context.Context,
+	idempotent bool,
+	newRequest func() (*http.Request, error),
+	checkRedirect func(*http.Request, []*http.Request) error,
+) (*http.Response, error) {
+	client := server.client(checkRedirect)
+	policy := server.RetryPolicy
+	if policy == nil {
+		policy = &RetryPolicy{}
+	}
+	for n := 1; ; n++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		resp, err := client.Do(req)
+		if resp != nil {
+			DefaultClockSkew.Observe(resp)
+		}
+		a := Attempt{
+			Number:   n,
+			Request:  req,
+			Response: resp,
+			Err:      err,
+		}
+		if n < policy.MaxAttempts && (idempotent || policy.RetryNonIdempotent) && retryable(ctx, resp, err) {
+			a.Delay = policy.delay(n)
+			a.Retry = true
+			if d, ok := retryAfter(resp); ok {
+				a.Delay = d
+				if policy.MaxDelay > 0 && d > policy.MaxDelay {
+					a.Retry = false
+				}
+			}
+			if deadline, ok := ctx.Deadline(); ok && now().Add(a.Delay).After(deadline) {
+				a.Retry = false
+			}
+		}
+		if policy.Hook != nil {
+			policy.Hook(&a)
+		}
+		if !a.Retry {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		t := time.NewTimer(a.Delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// flakyHandler responds to each request with the next of its status
+// codes, and with a 200 response once they have all been used.
+type flakyHandler struct {
+	header   http.Header
+	codes    []int
+	requests []*http.Request
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.requests = append(h.requests, req)
+	if len(h.codes) == 0 {
+		w.Write([]byte(`{"token_key": "abcs"}`))
+		return
+	}
+	code := h.codes[0]
+	h.codes = h.codes[1:]
+	for k, v := range h.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(`{"code": "ERROR", "message": "error"}`))
+}
+
+func TestRetryIdempotentRequest(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{codes: []int{502, 504}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	details, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(details, qt.Equals, `{"token_key": "abcs"}`)
+	c.Assert(h.requests, qt.HasLen, 3)
+	c.Assert(attempts, qt.HasLen, 3)
+	for i, a := range attempts {
+		c.Assert(a.Number, qt.Equals, i+1)
+		c.Assert(a.Retry, qt.Equals, i < 2)
+	}
+	c.Assert(attempts[0].Response.StatusCode, qt.Equals, http.StatusBadGateway)
+	c.Assert(attempts[1].Response.StatusCode, qt.Equals, http.StatusGatewayTimeout)
+	c.Assert(attempts[2].Response.StatusCode, qt.Equals, http.StatusOK)
+	// Every attempt is signed afresh.
+	nonces := make(map[string]bool)
+	for _, req := range h.requests {
+		checkSignature(c, &ssodata, req)
+		nonces[parseAuthorizationHeader(c, req.Header.Get("Authorization"))["oauth_nonce"]] = true
+	}
+	c.Assert(nonces, qt.HasLen, 3)
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 3,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `Get ".*": dial tcp .*`)
+	c.Assert(attempts, qt.HasLen, 3)
+	for _, a := range attempts {
+		c.Assert(a.Err, qt.Not(qt.IsNil))
+		c.Assert(a.Response, qt.IsNil)
+	}
+}
+
+func TestRetryDoesNotRetryRefusedRedirect(t *testing.T) {
+	c := qt.New(t)
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Errorf("unexpected request to other host")
+	}))
+	defer other.Close()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		http.Redirect(w, req, other.URL, http.StatusFound)
+	}))
+	defer srv.Close()
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `Get ".*": refusing to follow redirect .*`)
+	c.Assert(requests, qt.Equals, 1)
+	c.Assert(attempts, qt.HasLen, 1)
+	c.Assert(attempts[0].Retry, qt.IsFalse)
+}
+
+func TestRetryDoesNotRetryTLSFailure(t *testing.T) {
+	c := qt.New(t)
+
+	var requests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		// The default client does not trust the server's certificate.
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `Get ".*": .*certificate.*`)
+	c.Assert(requests, qt.Equals, 0)
+	c.Assert(attempts, qt.HasLen, 1)
+	c.Assert(attempts[0].Retry, qt.IsFalse)
+}
+
+func TestRetryDoesNotRetryUnsupportedScheme(t *testing.T) {
+	c := qt.New(t)
+
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: "ftp://login.example.com",
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `Get ".*": unsupported protocol scheme "ftp"`)
+	c.Assert(attempts, qt.HasLen, 1)
+	c.Assert(attempts[0].Retry, qt.IsFalse)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{codes: []int{503, 503, 503}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 2,
+			MinDelay:    time.Millisecond,
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `ERROR`)
+	c.Assert(h.requests, qt.HasLen, 2)
+}
+
+func TestRetryDoesNotRetryOtherErrors(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{codes: []int{401}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `ERROR`)
+	c.Assert(h.requests, qt.HasLen, 1)
+}
+
+func TestRetryNonIdempotent(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{codes: []int{503}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+		},
+	}
+	_, err := server.GetToken(email, password, tokenName)
+	c.Assert(err, qt.ErrorMatches, `error`)
+	c.Assert(h.requests, qt.HasLen, 1)
+
+	h.codes, h.requests = []int{503}, nil
+	server.RetryPolicy.RetryNonIdempotent = true
+	ssodata, err := server.GetToken(email, password, tokenName)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata.TokenKey, qt.Equals, "abcs")
+	c.Assert(h.requests, qt.HasLen, 2)
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{header: http.Header{"Retry-After": {"0"}}, codes: []int{429}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	var delays []time.Duration
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Hour,
+			Hook: func(a *Attempt) {
+				delays = append(delays, a.Delay)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(h.requests, qt.HasLen, 2)
+	c.Assert(delays, qt.DeepEquals, []time.Duration{0, 0})
+}
+
+func TestRetryAfterLongerThanMaxDelay(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{header: http.Header{"Retry-After": {"60"}}, codes: []int{503}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			MaxDelay:    10 * time.Second,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `ERROR`)
+	c.Assert(h.requests, qt.HasLen, 1)
+	c.Assert(attempts, qt.HasLen, 1)
+	c.Assert(attempts[0].Retry, qt.IsFalse)
+	c.Assert(attempts[0].Delay, qt.Equals, time.Minute)
+}
+
+func TestRetryRespectsContextDeadline(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{header: http.Header{"Retry-After": {"3600"}}, codes: []int{503}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	var attempts []Attempt
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Millisecond,
+			Hook: func(a *Attempt) {
+				attempts = append(attempts, *a)
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetailsContext(ctx, &ssodata)
+	c.Assert(err, qt.ErrorMatches, `ERROR`)
+	c.Assert(h.requests, qt.HasLen, 1)
+	c.Assert(attempts, qt.HasLen, 1)
+	c.Assert(attempts[0].Retry, qt.Equals, false)
+	c.Assert(attempts[0].Delay, qt.Equals, time.Hour)
+}
+
+func TestRetryCancelled(t *testing.T) {
+	c := qt.New(t)
+
+	h := &flakyHandler{codes: []int{503}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	server := UbuntuSSOServer{
+		baseUrl: srv.URL,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			MinDelay:    time.Hour,
+			Hook: func(a *Attempt) {
+				cancel()
+			},
+		},
+	}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetailsContext(ctx, &ssodata)
+	c.Assert(err, qt.Equals, context.Canceled)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	c := qt.New(t)
+
+	p := RetryPolicy{
+		MinDelay: time.Second,
+		MaxDelay: 5 * time.Second,
+	}
+	for retry, max := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 5: 5 * time.Second} {
+		if retry == 0 {
+			continue
+		}
+		for i := 0; i < 20; i++ {
+			d := p.delay(retry)
+			c.Assert(d >= max/2 && d <= max, qt.Equals, true, qt.Commentf("retry %d: delay %v", retry, d))
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// The examples in http://tools.ietf.org/html/rfc5849#section-1.2.
+var rfc5849Tests = []struct {
+	about        string
+	ssodata      SSOData
+	rp           RequestParameters
+	expectSig    string
+	expectHeader string
+}{{
+	about: "temporary credentials request",
+	ssodata: SSOData{
+		ConsumerKey:    "dpf43f3p2l4k3l03",
+		ConsumerSecret: "kd94hf93k423kf44",
+		Realm:          "Photos",
+	},
+	rp: RequestParameters{
+		HTTPMethod: "POST",
+		BaseURL:    "https://photos.example.net/initiate",
+		Params:     url.Values{"oauth_callback": {"http://printer.example.com/ready"}},
+		Nonce:      "wIjqoS",
+		Timestamp:  "137131200",
+	},
+	expectSig:    "74KNZJeDHnMBp0EMJ9ZHt/XKycU=",
+	expectHeader: `OAuth realm="Photos", oauth_consumer_key="dpf43f3p2l4k3l03", oauth_signature_method="HMAC-SHA1", oauth_signature="74KNZJeDHnMBp0EMJ9ZHt%2FXKycU%3D", oauth_timestamp="137131200", oauth_nonce="wIjqoS", oauth_callback="http%3A%2F%2Fprinter.example.com%2Fready"`,
+}, {
+	about: "token credentials request",
+	ssodata: SSOData{
+		ConsumerKey:    "dpf43f3p2l4k3l03",
+		ConsumerSecret: "kd94hf93k423kf44",
+		Realm:          "Photos",
+		TokenKey:       "hh5s93j4hdidpola",
+		TokenSecret:    "hdhd0244k9j7ao03",
+	},
+	rp: RequestParameters{
+		HTTPMethod: "POST",
+		BaseURL:    "https://photos.example.net/token",
+		Params:     url.Values{"oauth_verifier": {"hfdp7dh39dks9884"}},
+		Nonce:      "walatlh",
+		Timestamp:  "137131201",
+	},
+	expectSig:    "gKgrFCywp7rO0OXSjdot/IHF7IU=",
+	expectHeader: `OAuth realm="Photos", oauth_consumer_key="dpf43f3p2l4k3l03", oauth_token="hh5s93j4hdidpola", oauth_signature_method="HMAC-SHA1", oauth_signature="gKgrFCywp7rO0OXSjdot%2FIHF7IU%3D", oauth_timestamp="137131201", oauth_nonce="walatlh", oauth_verifier="hfdp7dh39dks9884"`,
+}, {
+	about: "protected resource request",
+	ssodata: SSOData{
+		ConsumerKey:    "dpf43f3p2l4k3l03",
+		ConsumerSecret: "kd94hf93k423kf44",
+		Realm:          "Photos",
+		TokenKey:       "nnch734d00sl2jdk",
+		TokenSecret:    "pfkkdhi9sl3r4s00",
+	},
+	rp: RequestParameters{
+		HTTPMethod: "GET",
+		BaseURL:    "http://photos.example.net/photos?file=vacation.jpg&size=original",
+		Params:     url.Values{"file": {"vacation.jpg"}, "size": {"original"}},
+		Nonce:      "chapoH",
+		Timestamp:  "137131202",
+	},
+	expectSig:    "MdpQcU8iPSUjWoN/UDMsK2sui9I=",
+	expectHeader: `OAuth realm="Photos", oauth_consumer_key="dpf43f3p2l4k3l03", oauth_token="nnch734d00sl2jdk", oauth_signature_method="HMAC-SHA1", oauth_signature="MdpQcU8iPSUjWoN%2FUDMsK2sui9I%3D", oauth_timestamp="137131202", oauth_nonce="chapoH"`,
+}}
+
+func TestRFC5849Examples(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range rfc5849Tests {
+		c.Run(test.about, func(c *qt.C) {
+			rp := test.rp
+			rp.SignatureMethod = HMACSHA1{}
+			rp.Strict = true
+			sig, err := rp.SignatureMethod.Signature(&test.ssodata, &rp)
+			c.Assert(err, qt.IsNil)
+			c.Assert(sig, qt.Equals, test.expectSig)
+			header, err := test.ssodata.GetAuthorizationHeader(&rp)
+			c.Assert(err, qt.IsNil)
+			c.Assert(header, qt.Equals, test.expectHeader)
+		})
+	}
+}
+
+var normalizeURLTests = []struct {
+	about        string
+	url          string
+	expectLegacy string
+	expectStrict string
+}{{
+	about:        "simple url",
+	url:          "http://example.com/path",
+	expectLegacy: "http://example.com/path",
+	expectStrict: "http://example.com/path",
+}, {
+	about:        "upper case scheme and host",
+	url:          "HTTP://Example.COM:80/Path",
+	expectLegacy: "http://Example.COM/Path",
+	expectStrict: "http://example.com/Path",
+}, {
+	about:        "non-standard port",
+	url:          "https://www.example.net:8080/?q=1",
+	expectLegacy: "https://www.example.net:8080/",
+	expectStrict: "https://www.example.net:8080/",
+}, {
+	about:        "empty path",
+	url:          "https://example.com",
+	expectLegacy: "https://example.com",
+	expectStrict: "https://example.com/",
+}, {
+	about:        "escaped path",
+	url:          "http://example.com/a%20b",
+	expectLegacy: "http://example.com/a b",
+	expectStrict: "http://example.com/a%20b",
+}, {
+	about:        "ipv6 literal with standard port",
+	url:          "https://[::1]:443/path",
+	expectLegacy: "https://[::1]/path",
+	expectStrict: "https://[::1]/path",
+}, {
+	about:        "ipv6 literal with non-standard port",
+	url:          "https://[::1]:8443/path",
+	expectLegacy: "https://[::1]:8443/path",
+	expectStrict: "https://[::1]:8443/path",
+}, {
+	about:        "ipv6 literal without port",
+	url:          "http://[2001:DB8::1]/path",
+	expectLegacy: "http://[2001:DB8::1]/path",
+	expectStrict: "http://[2001:db8::1]/path",
+}}
+
+func TestNormalizeURLConformance(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range normalizeURLTests {
+		c.Run(test.about, func(c *qt.C) {
+			legacy, err := normalizeURL(test.url, false)
+			c.Assert(err, qt.IsNil)
+			c.Check(legacy, qt.Equals, test.expectLegacy)
+			strict, err := normalizeURL(test.url, true)
+			c.Assert(err, qt.IsNil)
+			c.Check(strict, qt.Equals, test.expectStrict)
+		})
+	}
+}
+
+var signatureEncodingTests = []struct {
+	about        string
+	ssodata      SSOData
+	method       SignatureMethod
+	expectLegacy string
+	expectStrict string
+}{{
+	about: "plaintext secrets",
+	ssodata: SSOData{
+		ConsumerKey:    "key",
+		ConsumerSecret: "consumer secret",
+		Realm:          "API",
+		TokenKey:       "token",
+		TokenSecret:    "a&b=c",
+	},
+	method:       PLAINTEXT{},
+	expectLegacy: `OAuth realm="API", oauth_consumer_key="key", oauth_token="token", oauth_signature_method="PLAINTEXT", oauth_signature="consumer secret&a&b=c", oauth_timestamp="1358853126", oauth_nonce="10888885", oauth_version="1.0"`,
+	expectStrict: `OAuth realm="API", oauth_consumer_key="key", oauth_token="token", oauth_signature_method="PLAINTEXT", oauth_signature="consumer%2520secret%26a%2526b%253Dc", oauth_timestamp="1358853126", oauth_nonce="10888885"`,
+}, {
+	about: "plaintext without token",
+	ssodata: SSOData{
+		ConsumerKey:    "key",
+		ConsumerSecret: "secret",
+	},
+	method:       PLAINTEXT{},
+	expectLegacy: `OAuth realm="", oauth_consumer_key="key", oauth_token="", oauth_signature_method="PLAINTEXT", oauth_signature="secret&", oauth_timestamp="1358853126", oauth_nonce="10888885", oauth_version="1.0"`,
+	expectStrict: `OAuth oauth_consumer_key="key", oauth_signature_method="PLAINTEXT", oauth_signature="secret%26", oauth_timestamp="1358853126", oauth_nonce="10888885"`,
+}, {
+	about: "header values with reserved characters",
+	ssodata: SSOData{
+		ConsumerKey:    "a key~",
+		ConsumerSecret: "secret",
+		Realm:          "My Realm",
+		TokenKey:       "token+key",
+		TokenSecret:    "secret",
+	},
+	method:       PLAINTEXT{},
+	expectLegacy: `OAuth realm="My+Realm", oauth_consumer_key="a+key~", oauth_token="token%2Bkey", oauth_signature_method="PLAINTEXT", oauth_signature="secret&secret", oauth_timestamp="1358853126", oauth_nonce="10888885", oauth_version="1.0"`,
+	expectStrict: `OAuth realm="My Realm", oauth_consumer_key="a%20key~", oauth_token="token%2Bkey", oauth_signature_method="PLAINTEXT", oauth_signature="secret%26secret", oauth_timestamp="1358853126", oauth_nonce="10888885"`,
+}, {
+	about: "realm with quotes, backslashes and non-ASCII characters",
+	ssodata: SSOData{
+		ConsumerKey:    "key",
+		ConsumerSecret: "secret",
+		Realm:          `My "quoted" \ Réalm`,
+		TokenKey:       "token",
+		TokenSecret:    "secret",
+	},
+	method:       PLAINTEXT{},
+	expectLegacy: `OAuth realm="My+%22quoted%22+%5C+R%C3%A9alm", oauth_consumer_key="key", oauth_token="token", oauth_signature_method="PLAINTEXT", oauth_signature="secret&secret", oauth_timestamp="1358853126", oauth_nonce="10888885", oauth_version="1.0"`,
+	expectStrict: `OAuth realm="My \"quoted\" \\ Réalm", oauth_consumer_key="key", oauth_token="token", oauth_signature_method="PLAINTEXT", oauth_signature="secret%26secret", oauth_timestamp="1358853126", oauth_nonce="10888885"`,
+}}
+
+func TestSignatureEncodingConformance(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range signatureEncodingTests {
+		c.Run(test.about, func(c *qt.C) {
+			rp := RequestParameters{
+				HTTPMethod:      "GET",
+				BaseURL:         "https://localhost",
+				Nonce:           "10888885",
+				Timestamp:       "1358853126",
+				SignatureMethod: test.method,
+			}
+			header, err := test.ssodata.GetAuthorizationHeader(&rp)
+			c.Assert(err, qt.IsNil)
+			c.Check(header, qt.Equals, test.expectLegacy)
+			rp.Strict = true
+			header, err = test.ssodata.GetAuthorizationHeader(&rp)
+			c.Assert(err, qt.IsNil)
+			c.Check(header, qt.Equals, test.expectStrict)
+		})
+	}
+}
+
+// The example in http://tools.ietf.org/html/rfc5849#section-3.4.1.1.
+func TestRFC5849SignatureBaseString(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata := SSOData{
+		ConsumerKey: "9djdj82h48djs9d2",
+		TokenKey:    "kkk9d7dh3k39sjv7",
+	}
+	rp := RequestParameters{
+		HTTPMethod: "POST",
+		BaseURL:    "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b",
+		Params: url.Values{
+			"b5": {"=%3D"},
+			"a3": {"a", "2 q"},
+			"c@": {""},
+			"a2": {"r b"},
+			"c2": {""},
+		},
+		Nonce:           "7d8f3e4a",
+		Timestamp:       "137131201",
+		SignatureMethod: HMACSHA1{},
+		Strict:          true,
+	}
+	base, err := SignatureBaseString(&ssodata, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(base, qt.Equals, "POST&http%3A%2F%2Fexample.com%2Frequest&a2%3Dr%2520b%26a3%3D2%2520q%26a3%3Da%26b5%3D%253D%25253D%26c%2540%3D%26c2%3D%26oauth_consumer_key%3D9djdj82h48djs9d2%26oauth_nonce%3D7d8f3e4a%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk9d7dh3k39sjv7")
+}
+
+// In strict mode the HMAC-SHA1 key is made from the percent encoded
+// secrets and the method is upper case, see
+// http://tools.ietf.org/html/rfc5849#section-3.4.2 and
+// http://tools.ietf.org/html/rfc5849#section-3.4.1.1.
+func TestStrictHMACSHA1(t *testing.T) {
+	c := qt.New(t)
+
+	ssodata := SSOData{
+		ConsumerKey:    "key",
+		ConsumerSecret: "consumer secret",
+		TokenKey:       "token",
+		TokenSecret:    "a&b=c",
+	}
+	rp := RequestParameters{
+		HTTPMethod:      "get",
+		BaseURL:         "https://localhost/path",
+		Nonce:           "10888885",
+		Timestamp:       "1358853126",
+		SignatureMethod: HMACSHA1{},
+		Strict:          true,
+	}
+	base, err := SignatureBaseString(&ssodata, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(base, qt.Equals, "GET&https%3A%2F%2Flocalhost%2Fpath&oauth_consumer_key%3Dkey%26oauth_nonce%3D10888885%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1358853126%26oauth_token%3Dtoken")
+	sig, err := HMACSHA1{}.Signature(&ssodata, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sig, qt.Equals, "vRI8eKcDDZv8v6fcBOf/Zoxeay0=")
+
+	// The legacy mode signs with the unescaped secrets and also
+	// includes oauth_version.
+	rp.HTTPMethod = "GET"
+	rp.Strict = false
+	sig, err = HMACSHA1{}.Signature(&ssodata, &rp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sig, qt.Equals, "/bgam5qdIzOl9Y6f77n0jJQOiRU=")
+}
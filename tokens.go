@@ -0,0 +1,184 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TokenDetails holds the details of an OAuth token issued by Ubuntu
+// SSO. The token secret is never included.
+type TokenDetails struct {
+	// Href holds the path of the token in the API.
+	Href string `json:"href,omitempty"`
+
+	// TokenName holds the name given to the token when it was
+	// created.
+	TokenName string `json:"token_name"`
+
+	// TokenKey holds the key that identifies the token.
+	TokenKey string `json:"token_key"`
+
+	// ConsumerKey holds the consumer key the token was issued to.
+	ConsumerKey string `json:"consumer_key,omitempty"`
+
+	// Created holds the time the token was created. It is zero if the
+	// server did not report it.
+	Created time.Time `json:"-"`
+
+	// Updated holds the time the token was last updated. Ubuntu SSO
+	// updates tokens when they are used, so this is the best available
+	// indication of when the token was last used. It is zero if the
+	// server did not report it.
+	Updated time.Time `json:"-"`
+}
+
+// timeLayouts holds the layouts Ubuntu SSO has been seen to use for
+// the dates of tokens. All times are in UTC.
+var timeLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// parseTime parses a date returned by Ubuntu SSO.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q", s)
+}
+
+// UnmarshalJSON implements json.Unmarshaler by parsing the dates in the
+// formats used by Ubuntu SSO.
+func (td *TokenDetails) UnmarshalJSON(data []byte) error {
+	type plain TokenDetails
+	var v struct {
+		*plain
+		DateCreated string `json:"date_created"`
+		DateUpdated string `json:"date_updated"`
+	}
+	v.plain = (*plain)(td)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var err error
+	if td.Created, err = parseTime(v.DateCreated); err != nil {
+		return err
+	}
+	if td.Updated, err = parseTime(v.DateUpdated); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler by formatting the dates in the
+// format used by Ubuntu SSO.
+func (td TokenDetails) MarshalJSON() ([]byte, error) {
+	type plain TokenDetails
+	return json.Marshal(struct {
+		plain
+		DateCreated string `json:"date_created,omitempty"`
+		DateUpdated string `json:"date_updated,omitempty"`
+	}{
+		plain:       plain(td),
+		DateCreated: formatTime(td.Created),
+		DateUpdated: formatTime(td.Updated),
+	})
+}
+
+// formatTime formats a date as returned by Ubuntu SSO.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeLayouts[0])
+}
+
+// tokenPath returns the path of the token with the given key.
+func tokenPath(key string) string {
+	return "/api/v2/tokens/oauth/" + url.PathEscape(key)
+}
+
+// ListTokens returns the details of all the tokens on the account that
+// owns the given credentials. If an error is returned from the identity
+// server then it will be of type *Error.
+func (server UbuntuSSOServer) ListTokens(ctx context.Context, ssodata *SSOData) ([]TokenDetails, error) {
+	var account Account
+	if err := server.Do(ctx, ssodata, "GET", "/api/v2/accounts/"+url.PathEscape(ssodata.ConsumerKey), nil, &account); err != nil {
+		return nil, err
+	}
+	return account.Tokens, nil
+}
+
+// RevokeToken revokes the token with the given key, which must belong
+// to the account that owns the given credentials. If an error is
+// returned from the identity server then it will be of type *Error.
+func (server UbuntuSSOServer) RevokeToken(ctx context.Context, ssodata *SSOData, key string) error {
+	return server.Do(ctx, ssodata, "DELETE", tokenPath(key), nil, nil)
+}
+
+// RevokeTokens revokes every token on the account that owns the given
+// credentials for which match returns true. The token used to sign the
+// requests is never revoked. The tokens that were revoked are returned.
+// If revoking a token fails then the tokens revoked so far are returned
+// along with the error.
+func (server UbuntuSSOServer) RevokeTokens(ctx context.Context, ssodata *SSOData, match func(TokenDetails) bool) ([]TokenDetails, error) {
+	tokens, err := server.ListTokens(ctx, ssodata)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []TokenDetails
+	for _, td := range tokens {
+		if td.TokenKey == ssodata.TokenKey || !match(td) {
+			continue
+		}
+		if err := server.RevokeToken(ctx, ssodata, td.TokenKey); err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, td)
+	}
+	return revoked, nil
+}
+
+// TokenCreatedBefore returns a function for use with RevokeTokens that
+// matches tokens created before t. Tokens without a creation time are
+// not matched.
+func TokenCreatedBefore(t time.Time) func(TokenDetails) bool {
+	return func(td TokenDetails) bool {
+		return !td.Created.IsZero() && td.Created.Before(t)
+	}
+}
+
+// TokenUnusedSince returns a function for use with RevokeTokens that
+// matches tokens that have not been updated since t. Tokens without an
+// update time are matched by their creation time instead, and tokens
+// with neither are not matched.
+func TokenUnusedSince(t time.Time) func(TokenDetails) bool {
+	return func(td TokenDetails) bool {
+		last := td.Updated
+		if last.IsZero() {
+			last = td.Created
+		}
+		return !last.IsZero() && last.Before(t)
+	}
+}
+
+// TokenNameHasPrefix returns a function for use with RevokeTokens that
+// matches tokens whose name starts with prefix.
+func TokenNameHasPrefix(prefix string) func(TokenDetails) bool {
+	return func(td TokenDetails) bool {
+		return strings.HasPrefix(td.TokenName, prefix)
+	}
+}
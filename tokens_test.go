@@ -0,0 +1,206 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var testSSOData = &SSOData{
+	ConsumerKey:    consumerKey,
+	ConsumerSecret: consumerSecret,
+	Realm:          realm,
+	TokenKey:       tokenKey,
+	TokenSecret:    tokenSecret,
+	TokenName:      tokenName,
+}
+
+// tokensServer is a fake server holding an account with its tokens, as
+// they would be returned by Ubuntu SSO. Revoked tokens are removed from
+// the account.
+type tokensServer struct {
+	c      *qt.C
+	tokens []map[string]string
+}
+
+func (s *tokensServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := s.c
+	checkSignature(c, testSSOData, req)
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/api/v2/accounts/"+consumerKey:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"openid": consumerKey,
+			"email":  email,
+			"tokens": s.tokens,
+		})
+	case req.Method == "DELETE" && strings.HasPrefix(req.URL.Path, "/api/v2/tokens/oauth/"):
+		key := strings.TrimPrefix(req.URL.Path, "/api/v2/tokens/oauth/")
+		for i, t := range s.tokens {
+			if t["token_key"] == key {
+				s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Error{
+			Code:    CodeResourceNotFound,
+			Message: "Token not found",
+		})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+var testTokens = []map[string]string{{
+	"token_key":    tokenKey,
+	"token_name":   tokenName,
+	"href":         "/api/v2/tokens/oauth/" + tokenKey,
+	"date_created": "2013-01-16 14:03:36",
+	"date_updated": "2013-01-16 14:03:36",
+}, {
+	"token_key":    "old",
+	"token_name":   "bot-1",
+	"href":         "/api/v2/tokens/oauth/old",
+	"date_created": "2014-01-17T20:03:24.993",
+	"date_updated": "2014-01-22T13:35:49.867",
+}, {
+	"token_key":    "new",
+	"token_name":   "bot-2",
+	"href":         "/api/v2/tokens/oauth/new",
+	"date_created": "2020-05-01T10:00:00",
+}, {
+	"token_key":  "undated",
+	"token_name": "laptop",
+}}
+
+func TestListTokens(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&tokensServer{c: c, tokens: testTokens})
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	tokens, err := server.ListTokens(context.Background(), testSSOData)
+	c.Assert(err, qt.IsNil)
+	c.Assert(tokens, qt.DeepEquals, []TokenDetails{{
+		Href:      "/api/v2/tokens/oauth/" + tokenKey,
+		TokenName: tokenName,
+		TokenKey:  tokenKey,
+		Created:   time.Date(2013, 1, 16, 14, 3, 36, 0, time.UTC),
+		Updated:   time.Date(2013, 1, 16, 14, 3, 36, 0, time.UTC),
+	}, {
+		Href:      "/api/v2/tokens/oauth/old",
+		TokenName: "bot-1",
+		TokenKey:  "old",
+		Created:   time.Date(2014, 1, 17, 20, 3, 24, 993e6, time.UTC),
+		Updated:   time.Date(2014, 1, 22, 13, 35, 49, 867e6, time.UTC),
+	}, {
+		Href:      "/api/v2/tokens/oauth/new",
+		TokenName: "bot-2",
+		TokenKey:  "new",
+		Created:   time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+	}, {
+		TokenName: "laptop",
+		TokenKey:  "undated",
+	}})
+}
+
+func TestTokenDetailsRoundTrip(t *testing.T) {
+	c := qt.New(t)
+
+	td := TokenDetails{
+		TokenName: "bot-1",
+		TokenKey:  "old",
+		Created:   time.Date(2014, 1, 17, 20, 3, 24, 993e6, time.UTC),
+	}
+	data, err := json.Marshal(td)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, `{"token_name":"bot-1","token_key":"old","date_created":"2014-01-17T20:03:24.993"}`)
+	var td1 TokenDetails
+	err = json.Unmarshal(data, &td1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(td1, qt.DeepEquals, td)
+}
+
+func TestTokenDetailsBadTime(t *testing.T) {
+	c := qt.New(t)
+
+	var td TokenDetails
+	err := json.Unmarshal([]byte(`{"date_created": "yesterday"}`), &td)
+	c.Assert(err, qt.ErrorMatches, `cannot parse time "yesterday"`)
+}
+
+var revokeTokensTests = []struct {
+	about        string
+	match        func(TokenDetails) bool
+	expectKeys   []string
+	expectRemain []string
+}{{
+	about:        "created before",
+	match:        TokenCreatedBefore(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)),
+	expectKeys:   []string{"old"},
+	expectRemain: []string{tokenKey, "new", "undated"},
+}, {
+	about:        "unused since",
+	match:        TokenUnusedSince(time.Date(2014, 1, 20, 0, 0, 0, 0, time.UTC)),
+	expectRemain: []string{tokenKey, "old", "new", "undated"},
+}, {
+	about:        "name prefix",
+	match:        TokenNameHasPrefix("bot-"),
+	expectKeys:   []string{"old", "new"},
+	expectRemain: []string{tokenKey, "undated"},
+}, {
+	about:        "everything except the current token",
+	match:        func(TokenDetails) bool { return true },
+	expectKeys:   []string{"old", "new", "undated"},
+	expectRemain: []string{tokenKey},
+}}
+
+func TestRevokeTokens(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range revokeTokensTests {
+		c.Run(test.about, func(c *qt.C) {
+			srv := httptest.NewServer(&tokensServer{
+				c:      c,
+				tokens: append([]map[string]string(nil), testTokens...),
+			})
+			defer srv.Close()
+			server := UbuntuSSOServer{baseUrl: srv.URL}
+			revoked, err := server.RevokeTokens(context.Background(), testSSOData, test.match)
+			c.Assert(err, qt.IsNil)
+			var keys []string
+			for _, td := range revoked {
+				keys = append(keys, td.TokenKey)
+			}
+			c.Assert(keys, qt.DeepEquals, test.expectKeys)
+			tokens, err := server.ListTokens(context.Background(), testSSOData)
+			c.Assert(err, qt.IsNil)
+			var remain []string
+			for _, td := range tokens {
+				remain = append(remain, td.TokenKey)
+			}
+			c.Assert(remain, qt.DeepEquals, test.expectRemain)
+		})
+	}
+}
+
+func TestRevokeTokenNotFound(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&tokensServer{c: c, tokens: testTokens})
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	err := server.RevokeToken(context.Background(), testSSOData, "missing")
+	c.Assert(err, qt.ErrorMatches, "Token not found")
+	c.Assert(err.(*Error).Code, qt.Equals, CodeResourceNotFound)
+}
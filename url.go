@@ -5,6 +5,7 @@ package usso
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"sort"
 	"strings"
@@ -16,24 +17,48 @@ func normalizeHost(scheme, hostSpec string) string {
 		"http":  "80",
 		"https": "443",
 	}
-	hostParts := strings.Split(hostSpec, ":")
-	if len(hostParts) == 2 && hostParts[1] == standardPorts[scheme] {
+	host, port, err := net.SplitHostPort(hostSpec)
+	if err != nil {
+		// There's no port.
+		return hostSpec
+	}
+	if port == standardPorts[scheme] {
 		// There's a port, but it's the default one.  Leave it out.
-		return hostParts[0]
+		if strings.Contains(host, ":") {
+			// Keep the brackets around IPv6 literals.
+			return "[" + host + "]"
+		}
+		return host
 	}
 	return hostSpec
 }
 
 // Normalize the URL according to OAuth specs.
 func NormalizeURL(inputUrl string) (string, error) {
+	return normalizeURL(inputUrl, false)
+}
+
+// normalizeURL normalizes the URL as described in
+// http://tools.ietf.org/html/rfc5849#section-3.4.1.2. If strict is
+// false the scheme, host and path are used as given, as earlier versions
+// of this package did.
+func normalizeURL(inputUrl string, strict bool) (string, error) {
 	parsedUrl, err := url.Parse(inputUrl)
 	if err != nil {
 		return "", err
 	}
-
-	host := normalizeHost(parsedUrl.Scheme, parsedUrl.Host)
+	scheme, hostSpec, path := parsedUrl.Scheme, parsedUrl.Host, parsedUrl.Path
+	if strict {
+		scheme = strings.ToLower(scheme)
+		hostSpec = strings.ToLower(hostSpec)
+		path = parsedUrl.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+	}
+	host := normalizeHost(scheme, hostSpec)
 	normalizedUrl := fmt.Sprintf(
-		"%v://%v%v", parsedUrl.Scheme, host, parsedUrl.Path)
+		"%v://%v%v", scheme, host, path)
 	return normalizedUrl, nil
 }
 
@@ -58,11 +83,15 @@ func (p parameterSlice) Swap(i, j int) {
 }
 
 func (p parameterSlice) String() string {
+	return strings.Join(p.strings(), "&")
+}
+
+func (p parameterSlice) strings() []string {
 	ss := make([]string, len(p))
 	for i, param := range p {
 		ss[i] = param.String()
 	}
-	return strings.Join(ss, "&")
+	return ss
 }
 
 type parameter struct {
@@ -78,6 +107,11 @@ func (p parameter) String() string {
 // url.Values.Encode encoded the GET parameters in a consistent order we
 // do the encoding ourselves.
 func NormalizeParameters(parameters url.Values) (string, error) {
+	return normalizeParameters(parameters).String(), nil
+}
+
+// normalizeParameters returns the encoded parameters in sorted order.
+func normalizeParameters(parameters url.Values) parameterSlice {
 	var ps parameterSlice
 	for k, vs := range parameters {
 		if k == "oauth_signature" {
@@ -90,7 +124,7 @@ func NormalizeParameters(parameters url.Values) (string, error) {
 		}
 	}
 	sort.Sort(ps)
-	return ps.String(), nil
+	return ps
 }
 
 var escaped = [4]uint64{
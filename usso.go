@@ -4,16 +4,29 @@
 package usso
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type UbuntuSSOServer struct {
 	baseUrl              string
 	tokenRegistrationUrl string
+
+	// Client holds the HTTP client used to make requests to the
+	// server. If it is nil then http.DefaultClient is used.
+	Client *http.Client
+
+	// RetryPolicy holds the policy used to retry requests that fail
+	// with a transient error. If it is nil then requests are not
+	// retried.
+	RetryPolicy *RetryPolicy
 }
 
 // tokenURL returns the URL where the Ubuntu SSO tokens can be requested.
@@ -45,11 +58,28 @@ func (server UbuntuSSOServer) OpenIDURL() string {
 
 // ProductionUbuntuSSOServer represents the production Ubuntu SSO server
 // located at https://login.ubuntu.com.
-var ProductionUbuntuSSOServer = UbuntuSSOServer{"https://login.ubuntu.com", "https://one.ubuntu.com/oauth/sso-finished-so-get-tokens/"}
+var ProductionUbuntuSSOServer = UbuntuSSOServer{
+	baseUrl:              "https://login.ubuntu.com",
+	tokenRegistrationUrl: "https://one.ubuntu.com/oauth/sso-finished-so-get-tokens/",
+}
 
 // StagingUbuntuSSOServer represents the staging Ubuntu SSO server located
 // at https://login.staging.ubuntu.com. Use it for testing.
-var StagingUbuntuSSOServer = UbuntuSSOServer{"https://login.staging.ubuntu.com", "https://one.staging.ubuntu.com/oauth/sso-finished-so-get-tokens/"}
+var StagingUbuntuSSOServer = UbuntuSSOServer{
+	baseUrl:              "https://login.staging.ubuntu.com",
+	tokenRegistrationUrl: "https://one.staging.ubuntu.com/oauth/sso-finished-so-get-tokens/",
+}
+
+// NewUbuntuSSOServer returns an UbuntuSSOServer for the server at
+// baseURL, for example a local test server. The tokenRegistrationURL is
+// used as the callback in the OAuth flow returned by OAuthFlow and may
+// be blank if that flow is not used.
+func NewUbuntuSSOServer(baseURL, tokenRegistrationURL string) UbuntuSSOServer {
+	return UbuntuSSOServer{
+		baseUrl:              strings.TrimSuffix(baseURL, "/"),
+		tokenRegistrationUrl: tokenRegistrationURL,
+	}
+}
 
 // Giving user credentials and token name, retrieves oauth credentials
 // for the users, the oauth credentials can be used later to sign
@@ -66,6 +96,13 @@ func (server UbuntuSSOServer) GetToken(email string, password string, tokenName
 // will be of type *Error. If otp is blank then this is identical to
 // GetToken.
 func (server UbuntuSSOServer) GetTokenWithOTP(email, password, otp, tokenName string) (*SSOData, error) {
+	return server.GetTokenWithOTPContext(context.Background(), email, password, otp, tokenName)
+}
+
+// GetTokenWithOTPContext is like GetTokenWithOTP but uses the given
+// context for the request. Token creation is not idempotent, so the
+// request is only retried if the server's RetryPolicy allows it.
+func (server UbuntuSSOServer) GetTokenWithOTPContext(ctx context.Context, email, password, otp, tokenName string) (*SSOData, error) {
 	credentials := map[string]string{
 		"email":      email,
 		"password":   password,
@@ -74,28 +111,8 @@ func (server UbuntuSSOServer) GetTokenWithOTP(email, password, otp, tokenName st
 	if otp != "" {
 		credentials["otp"] = otp
 	}
-	jsonCredentials, err := json.Marshal(credentials)
-	if err != nil {
-		return nil, err
-	}
-	response, err := http.Post(
-		server.tokenURL(),
-		"application/json",
-		strings.NewReader(string(jsonCredentials)))
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-	if response.StatusCode != 200 && response.StatusCode != 201 {
-		return nil, getError(response)
-	}
-	ssodata := SSOData{}
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(body, &ssodata)
-	if err != nil {
+	var ssodata SSOData
+	if err := server.do(ctx, nil, "POST", "/api/v2/tokens/oauth", false, credentials, &ssodata); err != nil {
 		return nil, err
 	}
 	ssodata.Realm = "API"
@@ -107,24 +124,37 @@ type Error struct {
 	Message string                 `json:"message"`
 	Code    string                 `json:"code,omitempty"`
 	Extra   map[string]interface{} `json:"extra,omitempty"`
+
+	// StatusCode holds the HTTP status code of the response that
+	// contained the error.
+	StatusCode int `json:"-"`
+
+	// RetryAfter holds the time the server asked the client to wait
+	// before making another request, if any. It is usually set on
+	// errors with the code CodeTooManyRequests.
+	RetryAfter time.Duration `json:"-"`
 }
 
 // getError attempts to extract the most meaningful error that it can
 // from a response.
 func getError(resp *http.Response) *Error {
-	var ssoError Error
+	ssoError := Error{
+		StatusCode: resp.StatusCode,
+	}
+	ssoError.RetryAfter, _ = retryAfter(resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		ssoError.Code = resp.Status
 		ssoError.Message = resp.Status
-		return &ssoError
-	}
-	err = json.Unmarshal(body, &ssoError)
-	if err != nil {
+	} else if err := json.Unmarshal(body, &ssoError); err != nil {
 		// Attempt to pass the original error back in the best way possible
 		ssoError.Code = resp.Status
 		ssoError.Message = string(body)
-		return &ssoError
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && (ssoError.Code == "" || ssoError.Code == resp.Status) {
+		// Rate limits are often enforced in front of the server,
+		// which does not return a JSON error.
+		ssoError.Code = CodeTooManyRequests
 	}
 	return &ssoError
 }
@@ -141,45 +171,129 @@ func (err *Error) Error() string {
 	return fmt.Sprintf("%s (%s)", err.Message, strings.Join(extra, ", "))
 }
 
-// Returns all the Ubuntu SSO information related to this account.
-func (server UbuntuSSOServer) GetAccounts(ssodata *SSOData) (string, error) {
-	rp := RequestParameters{
-		BaseURL:         server.AccountsURL() + ssodata.ConsumerKey,
-		HTTPMethod:      "GET",
-		SignatureMethod: HMACSHA1{}}
+// Do sends a request to the given path on the server, which is relative
+// to the server's base URL. If ssodata is not nil the request is signed
+// with it. If requestBody is not nil it is sent encoded as JSON. If the
+// server responds with a successful status and responseBody is not nil
+// then the response is decoded as JSON into responseBody, or stored
+// unchanged if responseBody is a *[]byte. If an error is returned from
+// the identity server then it will be of type *Error.
+// Requests with the methods GET, HEAD, OPTIONS, PUT and DELETE are
+// considered idempotent and are retried according to the server's
+// RetryPolicy.
+func (server UbuntuSSOServer) Do(ctx context.Context, ssodata *SSOData, method, path string, requestBody, responseBody interface{}) error {
+	var idempotent bool
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		idempotent = true
+	}
+	return server.do(ctx, ssodata, method, path, idempotent, requestBody, responseBody)
+}
 
-	request, err := http.NewRequest(rp.HTTPMethod, rp.BaseURL, nil)
-	if err != nil {
-		return "", err
+// do implements Do, the caller decides whether the request is
+// idempotent.
+func (server UbuntuSSOServer) do(ctx context.Context, ssodata *SSOData, method, path string, idempotent bool, requestBody, responseBody interface{}) error {
+	return server.doURL(ctx, ssodata, method, server.baseUrl+path, idempotent, requestBody, responseBody)
+}
+
+// doURL is like do but sends the request to the absolute URL u.
+func (server UbuntuSSOServer) doURL(ctx context.Context, ssodata *SSOData, method, u string, idempotent bool, requestBody, responseBody interface{}) error {
+	var body []byte
+	if requestBody != nil {
+		var err error
+		body, err = json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+	}
+	rp := RequestParameters{
+		HTTPMethod:      method,
+		BaseURL:         u,
+		SignatureMethod: HMACSHA1{},
 	}
-	err = SignRequest(ssodata, &rp, request)
+	var checkRedirect func(*http.Request, []*http.Request) error
+	if ssodata != nil {
+		checkRedirect = ssodata.CheckRedirect(&rp)
+	}
+	response, err := server.send(ctx, idempotent, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, rp.BaseURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+		if ssodata == nil {
+			return req, nil
+		}
+		rp := rp
+		rp.Params = req.URL.Query()
+		if err := ssodata.SignRequest(&rp, req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}, checkRedirect)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return getError(response)
 	}
-	client := &http.Client{}
-	response, err := client.Do(request)
+	if responseBody == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if b, ok := responseBody.(*[]byte); ok {
+		*b = data
+		return nil
 	}
+	return json.Unmarshal(data, responseBody)
+}
+
+// Returns all the Ubuntu SSO information related to this account.
+func (server UbuntuSSOServer) GetAccounts(ssodata *SSOData) (string, error) {
+	return server.GetAccountsContext(context.Background(), ssodata)
+}
 
-	body, err := ioutil.ReadAll(response.Body)
+// GetAccountsContext is like GetAccounts but uses the given context for
+// the request.
+func (server UbuntuSSOServer) GetAccountsContext(ctx context.Context, ssodata *SSOData) (string, error) {
+	var body []byte
+	err := server.doURL(ctx, ssodata, "GET", server.AccountsURL()+ssodata.ConsumerKey, true, nil, &body)
 	if err != nil {
-		return "", err
+		// In theory, a response without JSON should never happen.
+		return "", codeError(err, "NO_JSON_RESPONSE")
 	}
-	if response.StatusCode == 200 {
-		return string(body), nil
-	} else {
-		var jsonMap map[string]interface{}
-		err = json.Unmarshal(body, &jsonMap)
-		// In theory, this should never happen.
-		if err != nil {
-			return "", fmt.Errorf("NO_JSON_RESPONSE")
-		}
-		code, ok := jsonMap["code"]
-		if !ok {
-			return "", fmt.Errorf("NO_CODE")
-		}
-		return "", fmt.Errorf("%v", code)
+	return string(body), nil
+}
+
+// codeError converts an *Error returned from Do to the form returned by
+// GetAccounts and GetTokenDetails, which hold only the error code. If
+// the response did not contain a JSON error then the code will be
+// noJSONCode. Errors of other types are returned unchanged.
+func codeError(err error, noJSONCode string) error {
+	ssoError, ok := err.(*Error)
+	if !ok {
+		return err
+	}
+	code := ssoError.Code
+	switch {
+	case strings.HasPrefix(code, strconv.Itoa(ssoError.StatusCode)+" "):
+		// getError uses the response status as the code when
+		// the response does not contain a JSON error.
+		code = noJSONCode
+	case code == "":
+		code = "NO_CODE"
+	}
+	return &Error{
+		Message:    code,
+		Code:       code,
+		StatusCode: ssoError.StatusCode,
 	}
 }
 
@@ -198,48 +312,30 @@ func GetAuthorizationHeader(
 
 // Returns all the Ubuntu SSO information related to this token.
 func (server UbuntuSSOServer) GetTokenDetails(ssodata *SSOData) (string, error) {
-	rp := RequestParameters{
-		BaseURL:         server.TokenDetailsURL() + ssodata.TokenKey,
-		HTTPMethod:      "GET",
-		SignatureMethod: HMACSHA1{}}
+	return server.GetTokenDetailsContext(context.Background(), ssodata)
+}
 
-	request, err := http.NewRequest(rp.HTTPMethod, rp.BaseURL, nil)
-	if err != nil {
-		return "", err
-	}
-	err = SignRequest(ssodata, &rp, request)
-	if err != nil {
-		return "", err
-	}
-	client := &http.Client{}
-	response, err := client.Do(request)
+// GetTokenDetailsContext is like GetTokenDetails but uses the given
+// context for the request.
+func (server UbuntuSSOServer) GetTokenDetailsContext(ctx context.Context, ssodata *SSOData) (string, error) {
+	var body []byte
+	err := server.doURL(ctx, ssodata, "GET", server.TokenDetailsURL()+ssodata.TokenKey, true, nil, &body)
 	if err != nil {
-		return "", err
-	}
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return "", err
-	}
-	if response.StatusCode == 200 {
-		return string(body), nil
-	} else {
-		var jsonMap map[string]interface{}
-		err = json.Unmarshal(body, &jsonMap)
 		// due to bug #1285176, it is possible to get non json code in the response.
-		if err != nil {
-			return "", fmt.Errorf("INVALID_CREDENTIALS")
-		}
-		code, ok := jsonMap["code"]
-		if !ok {
-			return "", fmt.Errorf("NO_CODE")
-		}
-		return "", fmt.Errorf("%v", code)
+		return "", codeError(err, "INVALID_CREDENTIALS")
 	}
+	return string(body), nil
 }
 
 // Verify the validity of the token, abusing the API to get the token details.
 func (server UbuntuSSOServer) IsTokenValid(ssodata *SSOData) (bool, error) {
-	details, err := server.GetTokenDetails(ssodata)
+	return server.IsTokenValidContext(context.Background(), ssodata)
+}
+
+// IsTokenValidContext is like IsTokenValid but uses the given context
+// for the request.
+func (server UbuntuSSOServer) IsTokenValidContext(ctx context.Context, ssodata *SSOData) (bool, error) {
+	details, err := server.GetTokenDetailsContext(ctx, ssodata)
 	if details != "" && err == nil {
 		return true, nil
 	} else {
@@ -4,6 +4,7 @@
 package usso
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -96,7 +97,7 @@ func TestGetTokenReturnsTokens(t *testing.T) {
 		panic(err)
 	}
 	server := newTestServer(string(jsonServerResponseData), "{}", 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 
 	// The returned information is correct.
@@ -124,7 +125,7 @@ func TestGetTokenFails(t *testing.T) {
 	c := qt.New(t)
 
 	server := newTestServer("{}", "{}", 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 	ssodata, err := testSSOServer.GetToken(email, "WRONG", tokenName)
 	c.Assert(err, qt.ErrorMatches, `404 page not found`+"\n"+`\{\}`)
@@ -160,7 +161,7 @@ func TestGetTokenDetails(t *testing.T) {
 		panic(err)
 	}
 	server := newTestServer(string(jsonServerResponseData), string(jsonTokenDetails), 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 	ssodata, err := testSSOServer.GetToken(email, password, tokenName)
 	// The returned information is correct.
@@ -170,6 +171,28 @@ func TestGetTokenDetails(t *testing.T) {
 	c.Assert(token_details, qt.Equals, string(jsonTokenDetails))
 }
 
+// A successful response is returned unchanged, even when it is not
+// JSON.
+func TestGetTokenDetailsNonJSON(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer srv.Close()
+	ssoServer := UbuntuSSOServer{baseUrl: srv.URL}
+	ssodata, _, _ := defaults(c)
+	details, err := ssoServer.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(details, qt.Equals, "not json")
+	accounts, err := ssoServer.GetAccounts(&ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accounts, qt.Equals, "not json")
+	valid, err := ssoServer.IsTokenValid(&ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+}
+
 func TestGetTokenWithOTP(t *testing.T) {
 	c := qt.New(t)
 
@@ -189,7 +212,7 @@ func TestGetTokenWithOTP(t *testing.T) {
 		panic(err)
 	}
 	server := newTestServer(string(jsonServerResponseData), "{}", 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 
 	// The returned information is correct.
@@ -240,7 +263,7 @@ func TestTokenValidity(t *testing.T) {
 		panic(err)
 	}
 	server := newTestServer(string(jsonServerResponseData), string(jsonTokenDetails), 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 	ssodata, err := testSSOServer.GetToken(email, password, tokenName)
 	// The returned information is correct.
@@ -257,7 +280,7 @@ func TestInvalidToken(t *testing.T) {
 	c := qt.New(t)
 
 	server := newTestServer("{}", "{}", 200)
-	var testSSOServer = &UbuntuSSOServer{server.URL, ""}
+	var testSSOServer = &UbuntuSSOServer{baseUrl: server.URL}
 	defer server.Close()
 	ssodata := SSOData{"WRONG", "", "", "", "", ""}
 	validity, err := testSSOServer.IsTokenValid(&ssodata)
@@ -320,3 +343,80 @@ type errorReader struct {
 func (r errorReader) Read(b []byte) (int, error) {
 	return 0, r.Err
 }
+
+func TestDo(t *testing.T) {
+	c := qt.New(t)
+
+	var request map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, qt.Equals, "PUT")
+		c.Check(req.URL.Path, qt.Equals, "/api/v2/things/1")
+		c.Check(req.Header.Get("Content-Type"), qt.Equals, "application/json")
+		checkSignature(c, &SSOData{
+			ConsumerKey:    consumerKey,
+			ConsumerSecret: consumerSecret,
+			TokenKey:       tokenKey,
+			TokenSecret:    tokenSecret,
+		}, req)
+		err := json.NewDecoder(req.Body).Decode(&request)
+		c.Check(err, qt.IsNil)
+		fmt.Fprint(w, `{"id": 1, "name": "thing"}`)
+	}))
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	ssodata, _, _ := defaults(c)
+	var response struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	err := server.Do(context.Background(), &ssodata, "PUT", "/api/v2/things/1", map[string]string{"name": "thing"}, &response)
+	c.Assert(err, qt.IsNil)
+	c.Assert(request, qt.DeepEquals, map[string]interface{}{"name": "thing"})
+	c.Assert(response.ID, qt.Equals, 1)
+	c.Assert(response.Name, qt.Equals, "thing")
+}
+
+func TestDoError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Header.Get("Authorization"), qt.Equals, "")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"code": "ACCOUNT_SUSPENDED", "message": "Your account has been suspended."}`)
+	}))
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	err := server.Do(context.Background(), nil, "GET", "/api/v2/things", nil, nil)
+	c.Assert(err, qt.ErrorMatches, `Your account has been suspended.`)
+	c.Assert(err, qt.DeepEquals, &Error{
+		Message:    "Your account has been suspended.",
+		Code:       "ACCOUNT_SUSPENDED",
+		StatusCode: http.StatusForbidden,
+	})
+}
+
+// GetTokenDetails reports errors with only their code, as it always
+// has.
+func TestGetTokenDetailsError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"code": "INVALID_CREDENTIALS", "message": "Provided credentials are invalid."}`)
+	}))
+	defer srv.Close()
+	server := UbuntuSSOServer{baseUrl: srv.URL}
+	ssodata, _, _ := defaults(c)
+	_, err := server.GetTokenDetails(&ssodata)
+	c.Assert(err, qt.ErrorMatches, `INVALID_CREDENTIALS`)
+	c.Assert(err.(*Error).StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func TestNewUbuntuSSOServer(t *testing.T) {
+	c := qt.New(t)
+
+	server := NewUbuntuSSOServer("http://127.0.0.1:8080/", "http://127.0.0.1:8080/finished")
+	c.Assert(server.LoginURL(), qt.Equals, "http://127.0.0.1:8080")
+	c.Assert(server.AccountsURL(), qt.Equals, "http://127.0.0.1:8080/api/v2/accounts/")
+	c.Assert(server.TokenRegistrationURL(), qt.Equals, "http://127.0.0.1:8080/finished")
+}
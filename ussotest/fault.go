@@ -0,0 +1,205 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package ussotest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault describes a fault injected into the responses to requests made
+// to the server. The fields are applied in order: the response is
+// delayed, then the connection is reset or a response is written with
+// the status, headers and body changed as described.
+//
+// Note that the Go HTTP client transparently retries some idempotent
+// requests when a reused connection is reset, so a Reset fault for a
+// GET request may be used by more than one attempt.
+type Fault struct {
+	// Method holds the HTTP method of the requests the fault applies
+	// to. If it is blank the fault applies to requests with any
+	// method.
+	Method string
+
+	// Path holds the path prefix of the requests the fault applies
+	// to. If it is blank the fault applies to requests for any path.
+	Path string
+
+	// Count holds the number of matching requests the fault applies
+	// to. Zero means one request; a negative value means every
+	// request.
+	Count int
+
+	// Delay holds the time to wait before responding. The wait ends
+	// early if the client gives up on the request.
+	Delay time.Duration
+
+	// Reset causes the connection to be closed without writing a
+	// response.
+	Reset bool
+
+	// Status, if not zero, replaces the status code of the response.
+	Status int
+
+	// Body, if not blank, replaces the body of the response, and the
+	// request is not otherwise processed. It can be used to return
+	// malformed JSON or an HTML error page.
+	Body string
+
+	// ContentType, if not blank, replaces the Content-Type of the
+	// response. If Body is set and ContentType is blank then the
+	// Content-Type is guessed from the body.
+	ContentType string
+
+	// RetryAfter, if not blank, is sent in the Retry-After header of
+	// the response.
+	RetryAfter string
+
+	// Truncate causes only the first half of the response body to be
+	// written before the connection is closed, although the
+	// Content-Length header gives the full length.
+	Truncate bool
+}
+
+// ServiceUnavailable returns a fault that responds to the matching
+// requests with the status 503 (Service Unavailable), an HTML error page
+// and the given Retry-After header, if it is not blank.
+func ServiceUnavailable(method, path string, count int, retryAfter string) Fault {
+	return Fault{
+		Method:     method,
+		Path:       path,
+		Count:      count,
+		Status:     http.StatusServiceUnavailable,
+		Body:       "<html><body><h1>503 Service Unavailable</h1></body></html>",
+		RetryAfter: retryAfter,
+	}
+}
+
+// TooManyRequests returns a fault that responds to the matching
+// requests with the status 429 (Too Many Requests), a JSON error with
+// the code TOO_MANY_REQUESTS and a Retry-After header of the given
+// number of seconds.
+func TooManyRequests(method, path string, count int, retryAfter int) Fault {
+	return Fault{
+		Method:     method,
+		Path:       path,
+		Count:      count,
+		Status:     http.StatusTooManyRequests,
+		Body:       `{"code": "TOO_MANY_REQUESTS", "message": "Too many requests"}`,
+		RetryAfter: strconv.Itoa(retryAfter),
+	}
+}
+
+// AddFault arranges for requests matching f to be served with the fault
+// described by f. Faults are matched in the order they were added, and
+// at most one fault applies to each request.
+func (h *Handler) AddFault(f Fault) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.faults = append(h.faults, &f)
+}
+
+// ClearFaults removes all the faults that have not yet been used.
+func (h *Handler) ClearFaults() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.faults = nil
+}
+
+// fault returns a copy of the first fault that matches req, and
+// reports whether there was one. The fault is removed if it has been
+// used for the last time.
+func (h *Handler) fault(req *http.Request) (Fault, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, f := range h.faults {
+		if !f.matches(req) {
+			continue
+		}
+		switch {
+		case f.Count < 0:
+		case f.Count > 1:
+			f.Count--
+		default:
+			h.faults = append(h.faults[:i], h.faults[i+1:]...)
+		}
+		return *f, true
+	}
+	return Fault{}, false
+}
+
+// matches reports whether the fault applies to req.
+func (f *Fault) matches(req *http.Request) bool {
+	return (f.Method == "" || f.Method == req.Method) && strings.HasPrefix(req.URL.Path, f.Path)
+}
+
+// serve serves req with the fault, using h to create the response if
+// the fault does not replace it entirely.
+func (f Fault) serve(w http.ResponseWriter, req *http.Request, h http.HandlerFunc) {
+	if f.Delay > 0 {
+		t := time.NewTimer(f.Delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return
+		}
+	}
+	if f.Reset {
+		closeConnection(w)
+		return
+	}
+	rec := httptest.NewRecorder()
+	if f.Body == "" {
+		h(rec, req)
+	}
+	header := w.Header()
+	for k, v := range rec.Header() {
+		header[k] = v
+	}
+	status := rec.Code
+	if f.Status != 0 {
+		status = f.Status
+	}
+	body := rec.Body.Bytes()
+	if f.Body != "" {
+		body = []byte(f.Body)
+		header.Del("Content-Type")
+	}
+	if f.ContentType != "" {
+		header.Set("Content-Type", f.ContentType)
+	} else if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+	if f.RetryAfter != "" {
+		header.Set("Retry-After", f.RetryAfter)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if f.Truncate {
+		w.Write(body[:len(body)/2])
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		closeConnection(w)
+		return
+	}
+	w.Write(body)
+}
+
+// closeConnection closes the connection underlying w.
+func closeConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic("cannot reset connection: ResponseWriter is not a Hijacker")
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
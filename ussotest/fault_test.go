@@ -0,0 +1,214 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package ussotest_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+)
+
+func TestFaultDelay(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	ssodata := srv.AddToken(email, "my-token")
+	srv.AddFault(ussotest.Fault{
+		Path:  "/api/v2/tokens/oauth/",
+		Delay: time.Minute,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := srv.UbuntuSSOServer().GetTokenDetailsContext(ctx, ssodata)
+	c.Assert(err, qt.ErrorMatches, `.*context deadline exceeded.*`)
+
+	srv.AddFault(ussotest.Fault{
+		Path:  "/api/v2/tokens/oauth/",
+		Delay: 10 * time.Millisecond,
+	})
+	start := time.Now()
+	valid, err := srv.UbuntuSSOServer().IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+	c.Assert(time.Since(start) >= 10*time.Millisecond, qt.IsTrue)
+}
+
+func TestFaultServiceUnavailableRetried(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	ssodata := srv.AddToken(email, "my-token")
+	srv.AddFault(ussotest.ServiceUnavailable("GET", "/api/v2/tokens/oauth/", 2, "0"))
+	var attempts []int
+	server := srv.UbuntuSSOServer()
+	server.RetryPolicy = &usso.RetryPolicy{
+		MaxAttempts: 3,
+		MinDelay:    time.Millisecond,
+		Hook: func(a *usso.Attempt) {
+			attempts = append(attempts, a.Response.StatusCode)
+		},
+	}
+	valid, err := server.IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+	c.Assert(attempts, qt.DeepEquals, []int{503, 503, 200})
+}
+
+func TestFaultNonJSONErrorPage(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	ssodata := srv.AddToken(email, "my-token")
+	srv.AddFault(ussotest.ServiceUnavailable("", "", 1, ""))
+	// Bug #1285176: GetTokenDetails reports responses without a JSON
+	// error as invalid credentials, but the status is preserved.
+	_, err := srv.UbuntuSSOServer().GetTokenDetails(ssodata)
+	c.Assert(err, qt.ErrorMatches, usso.CodeInvalidCredentials)
+	c.Assert(err.(*usso.Error).StatusCode, qt.Equals, http.StatusServiceUnavailable)
+
+	srv.AddFault(ussotest.ServiceUnavailable("POST", "/api/v2/tokens/oauth", 1, ""))
+	_, err = srv.UbuntuSSOServer().GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, `<html>.*503 Service Unavailable.*`)
+	c.Assert(err.(*usso.Error).Code, qt.Equals, "503 Service Unavailable")
+}
+
+func TestFaultTooManyRequests(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.TooManyRequests("POST", "/api/v2/tokens/oauth", 1, 30))
+	_, err := srv.UbuntuSSOServer().GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, "Too many requests")
+	ssoError := err.(*usso.Error)
+	c.Assert(ssoError.Code, qt.Equals, usso.CodeTooManyRequests)
+	c.Assert(ssoError.RetryAfter, qt.Equals, 30*time.Second)
+	c.Assert(srv.Tokens(email), qt.HasLen, 0)
+}
+
+func TestFaultStatusOverride(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.Fault{
+		Method:     "POST",
+		Path:       "/api/v2/tokens/oauth",
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: "0",
+	})
+	server := srv.UbuntuSSOServer()
+	server.RetryPolicy = &usso.RetryPolicy{
+		MaxAttempts:        2,
+		RetryNonIdempotent: true,
+	}
+	// The request is processed before the status is replaced, so
+	// retrying a non-idempotent request creates two tokens.
+	_, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.Tokens(email), qt.HasLen, 2)
+}
+
+func TestFaultMalformedPayload(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.Fault{
+		Method: "POST",
+		Path:   "/api/v2/tokens/oauth",
+		Body:   `{"token_key": `,
+	})
+	_, err := srv.UbuntuSSOServer().GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, "unexpected end of JSON input")
+}
+
+func TestFaultTruncate(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.Fault{
+		Method:   "POST",
+		Path:     "/api/v2/tokens/oauth",
+		Truncate: true,
+	})
+	_, err := srv.UbuntuSSOServer().GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, "unexpected EOF")
+}
+
+func TestFaultReset(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.Fault{
+		Method: "POST",
+		Path:   "/api/v2/tokens/oauth",
+		Reset:  true,
+	})
+	_, err := srv.UbuntuSSOServer().GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, `Post "?http://.*"?: EOF`)
+	c.Assert(srv.Tokens(email), qt.HasLen, 0)
+}
+
+func TestFaultCount(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddFault(ussotest.TooManyRequests("POST", "", -1, 1))
+	server := srv.UbuntuSSOServer()
+	for i := 0; i < 3; i++ {
+		_, err := server.GetToken(email, password, "my-token")
+		c.Assert(err, qt.ErrorMatches, "Too many requests")
+	}
+	srv.ClearFaults()
+	_, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+}
+
+// Faults may be used by concurrent requests.
+func TestFaultCountConcurrent(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	ssodata := srv.AddToken(email, "my-token")
+	srv.AddFault(ussotest.ServiceUnavailable("GET", "/api/v2/tokens/oauth/", 10, "0"))
+	server := srv.UbuntuSSOServer()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.GetTokenDetails(ssodata)
+			c.Check(err, qt.Not(qt.IsNil))
+		}()
+	}
+	wg.Wait()
+	valid, err := server.IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package ussotest
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/usso"
+)
+
+// verify checks the OAuth signature of req and returns the account that
+// owns the token used. The OAuth parameters may be sent in the
+// Authorization header, the query string or a form-encoded body, and
+// both the legacy and strict forms of signature produced by the usso
+// package are accepted. It must be called with h.mu held.
+func (h *Handler) verify(req *http.Request) (*account, error) {
+	params, err := requestParameters(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(params["oauth_signature"]) != 1 {
+		return nil, errgo.New("missing OAuth signature")
+	}
+	t, ok := h.tokens[params.Get("oauth_token")]
+	if !ok {
+		return nil, errgo.New("invalid token")
+	}
+	a := h.users[t.email]
+	if a == nil || params.Get("oauth_consumer_key") != a.OpenID {
+		return nil, errgo.New("invalid consumer key")
+	}
+	var method usso.SignatureMethod
+	switch params.Get("oauth_signature_method") {
+	case "HMAC-SHA1":
+		method = usso.HMACSHA1{}
+	case "PLAINTEXT":
+		method = usso.PLAINTEXT{}
+	default:
+		return nil, errgo.Newf("unsupported signature method %q", params.Get("oauth_signature_method"))
+	}
+	signature := params.Get("oauth_signature")
+	params.Del("oauth_signature")
+	ssodata := &usso.SSOData{
+		ConsumerKey:    a.OpenID,
+		ConsumerSecret: a.ConsumerSecret,
+		TokenKey:       t.TokenKey,
+		TokenSecret:    t.secret,
+	}
+	rp := usso.RequestParameters{
+		HTTPMethod:      req.Method,
+		BaseURL:         requestBaseURL(req) + req.URL.EscapedPath(),
+		Params:          params,
+		Nonce:           params.Get("oauth_nonce"),
+		Timestamp:       params.Get("oauth_timestamp"),
+		SignatureMethod: method,
+		// Only strict signatures omit the version.
+		Strict: params.Get("oauth_version") == "",
+	}
+	sig, err := method.Signature(ssodata, &rp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if sig != signature {
+		return nil, errgo.New("invalid signature")
+	}
+	return a, nil
+}
+
+// requestBaseURL returns the scheme and host that req was sent to.
+func requestBaseURL(req *http.Request) string {
+	if req.TLS != nil {
+		return "https://" + req.Host
+	}
+	return "http://" + req.Host
+}
+
+// requestParameters returns the parameters of req that are included in
+// its signature: those in the query string, those in a form-encoded
+// body and, other than the realm, those in the OAuth Authorization
+// header. See http://tools.ietf.org/html/rfc5849#section-3.4.1.3.1.
+func requestParameters(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid request body")
+		}
+		for k, v := range form {
+			params[k] = append(params[k], v...)
+		}
+	}
+	if h := req.Header.Get("Authorization"); h != "" {
+		header, err := usso.ParseAuthorizationHeader(h)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		header.Del("realm")
+		for k, v := range header {
+			params[k] = append(params[k], v...)
+		}
+	}
+	return params, nil
+}
@@ -0,0 +1,385 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+// Package record records the HTTP interactions between a client and
+// Ubuntu SSO so that they can be replayed in tests without access to the
+// server.
+//
+// A Recorder is an http.RoundTripper that passes requests on to another
+// transport and records each request and its response, with passwords,
+// secrets, discharge macaroons and signatures replaced by Redacted. A
+// Replayer is an http.RoundTripper that answers requests with the
+// recorded responses. Either can be used as the Transport of the
+// http.Client of an UbuntuSSOServer:
+//
+//	rec := &record.Recorder{}
+//	server := usso.StagingUbuntuSSOServer
+//	server.Client = &http.Client{Transport: rec}
+//	// make requests...
+//	err := rec.Save("testdata/staging.json")
+//
+// and later:
+//
+//	interactions, err := record.Load("testdata/staging.json")
+//	server.Client = &http.Client{Transport: record.NewReplayer(interactions)}
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Redacted replaces the values that are removed from recordings.
+const Redacted = "REDACTED"
+
+// Interaction holds a request and the response to it.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request holds a recorded request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Response holds a recorded response.
+type Response struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// ScrubbedFields holds the names of the JSON and form fields whose
+// values are replaced by Redacted in recorded bodies and URLs.
+var ScrubbedFields = []string{
+	"password",
+	"otp",
+	"captcha_solution",
+	"consumer_secret",
+	"token_secret",
+	"oauth_signature",
+	"oauth_token_secret",
+	"discharge_macaroon",
+	"openid.macaroon.discharge",
+}
+
+// volatileParameters holds the OAuth parameters that differ for every
+// request and are ignored when matching requests.
+var volatileParameters = []string{
+	"oauth_nonce",
+	"oauth_timestamp",
+	"oauth_signature",
+}
+
+// droppedHeaders holds the headers that are not recorded. The Date
+// header is dropped so that replaying old responses does not affect
+// the clock skew compensation of the usso package, and Content-Length
+// because scrubbing can change the length of the body.
+var droppedHeaders = []string{
+	"Cookie",
+	"Set-Cookie",
+	"Date",
+	"Content-Length",
+}
+
+// Recorder is an http.RoundTripper that records the requests it sends
+// and the responses to them. A Recorder is safe for concurrent use.
+type Recorder struct {
+	// Transport holds the transport used to send requests. If it is
+	// nil then http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// A RoundTripper must not modify the request, so the
+		// body that has been read is sent with a copy.
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	t := r.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    scrubURL(req.URL),
+			Header: scrubHeader(req.Header),
+			Body:   scrubBody(req.Header.Get("Content-Type"), reqBody),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     scrubHeader(resp.Header),
+			Body:       scrubBody(resp.Header.Get("Content-Type"), respBody),
+		},
+	})
+	return resp, nil
+}
+
+// Interactions returns the interactions recorded so far.
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Interaction(nil), r.interactions...)
+}
+
+// Save writes the interactions recorded so far to the named file as
+// JSON.
+func (r *Recorder) Save(path string) error {
+	data, err := json.MarshalIndent(r.Interactions(), "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Load reads interactions saved by Recorder.Save from the named file.
+func Load(path string) ([]Interaction, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var interactions []Interaction
+	if err := json.Unmarshal(data, &interactions); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", path)
+	}
+	return interactions, nil
+}
+
+// Replayer is an http.RoundTripper that responds to requests with
+// recorded responses. A request matches a recorded interaction if it
+// has the same method, URL and body, ignoring the OAuth nonce,
+// timestamp and signature and any scrubbed values. Each interaction is
+// used at most once, in the order they were recorded. A Replayer is
+// safe for concurrent use.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// NewReplayer returns a Replayer that responds with the given
+// interactions.
+func NewReplayer(interactions []Interaction) *Replayer {
+	return &Replayer{
+		interactions: interactions,
+		used:         make([]bool, len(interactions)),
+	}
+}
+
+// RoundTrip implements http.RoundTripper. If no unused interaction
+// matches req, it returns an error.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := matchKey(req.Method, scrubURL(req.URL), scrubBody(req.Header.Get("Content-Type"), body))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] {
+			continue
+		}
+		u, err := url.Parse(in.Request.URL)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid recorded URL")
+		}
+		if matchKey(in.Request.Method, scrubURL(u), in.Request.Body) != key {
+			continue
+		}
+		r.used[i] = true
+		header := make(http.Header)
+		for k, v := range in.Response.Header {
+			header[k] = v
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Response.StatusCode, http.StatusText(in.Response.StatusCode)),
+			StatusCode:    in.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(in.Response.Body)),
+			ContentLength: int64(len(in.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, errgo.Newf("no recorded interaction matches %s %s", req.Method, req.URL)
+}
+
+// Unused returns the interactions that have not been used to respond to
+// a request.
+func (r *Replayer) Unused() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []Interaction
+	for i, in := range r.interactions {
+		if !r.used[i] {
+			unused = append(unused, in)
+		}
+	}
+	return unused
+}
+
+// matchKey returns the value compared when matching requests.
+func matchKey(method, u, body string) string {
+	return method + " " + u + "\n" + body
+}
+
+// scrubURL returns u with the values of scrubbed fields in the query
+// replaced and the volatile OAuth parameters removed.
+func scrubURL(u *url.URL) string {
+	u1 := *u
+	q := u1.Query()
+	if len(q) == 0 {
+		return u1.String()
+	}
+	for _, k := range volatileParameters {
+		q.Del(k)
+	}
+	scrubValues(q)
+	u1.RawQuery = q.Encode()
+	return u1.String()
+}
+
+// scrubHeader returns a copy of h without the dropped headers and with
+// the volatile OAuth parameters in the Authorization header replaced.
+// The credentials in Authorization headers that do not use the OAuth
+// scheme are replaced entirely.
+func scrubHeader(h http.Header) http.Header {
+	h1 := make(http.Header)
+	for k, v := range h {
+		h1[k] = append([]string(nil), v...)
+	}
+	for _, k := range droppedHeaders {
+		h1.Del(k)
+	}
+	if auth := h1.Get("Authorization"); strings.HasPrefix(auth, "OAuth ") {
+		h1.Set("Authorization", authParameterPattern.ReplaceAllString(auth, `$1="`+Redacted+`"`))
+	} else if auth != "" {
+		scheme := strings.SplitN(auth, " ", 2)[0]
+		h1.Set("Authorization", scheme+" "+Redacted)
+	}
+	return h1
+}
+
+// authParameterPattern matches the volatile parameters in an
+// Authorization header.
+var authParameterPattern = regexp.MustCompile(`(oauth_signature|oauth_nonce|oauth_timestamp)="[^"]*"`)
+
+// scrubBody returns body with the values of scrubbed fields replaced,
+// if it is JSON or form encoded, and the volatile OAuth parameters
+// removed from form encoded bodies.
+func scrubBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return string(body)
+		}
+		data, err := json.Marshal(scrubJSON(v))
+		if err != nil {
+			return string(body)
+		}
+		return string(data)
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		for _, k := range volatileParameters {
+			q.Del(k)
+		}
+		scrubValues(q)
+		return q.Encode()
+	}
+	return string(body)
+}
+
+// scrubJSON replaces the values of scrubbed fields in v, which holds
+// decoded JSON.
+func scrubJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if contains(ScrubbedFields, k) {
+				v[k] = Redacted
+			} else {
+				v[k] = scrubJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = scrubJSON(e)
+		}
+	}
+	return v
+}
+
+// scrubValues replaces the values of scrubbed fields in v.
+func scrubValues(v url.Values) {
+	for k := range v {
+		if contains(ScrubbedFields, k) {
+			v[k] = []string{Redacted}
+		}
+	}
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package record_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+	"github.com/juju/usso/ussotest/record"
+)
+
+const (
+	email    = "foo@bar.com"
+	password = "foobarpwd"
+)
+
+// session performs a typical series of requests with server.
+func session(c *qt.C, server usso.UbuntuSSOServer) *usso.SSOData {
+	_, err := server.GetToken(email, "wrong", "my-token")
+	c.Assert(err, qt.ErrorMatches, "Provided email/password is not correct.")
+	ssodata, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+	valid, err := server.IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+	tokens, err := server.ListTokens(context.Background(), ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(tokens, qt.HasLen, 1)
+	c.Assert(tokens[0].TokenName, qt.Equals, "my-token")
+	return ssodata
+}
+
+func TestRecordReplay(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	rec := &record.Recorder{}
+	server := srv.UbuntuSSOServer()
+	server.Client = &http.Client{Transport: rec}
+	recorded := session(c, server)
+	c.Assert(rec.Interactions(), qt.HasLen, 4)
+
+	path := filepath.Join(c.Mkdir(), "session.json")
+	err := rec.Save(path)
+	c.Assert(err, qt.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	for _, secret := range []string{password, recorded.ConsumerSecret, recorded.TokenSecret, "oauth_nonce=\"1", "Date"} {
+		c.Assert(strings.Contains(string(data), secret), qt.IsFalse, qt.Commentf("%q recorded", secret))
+	}
+	c.Assert(strings.Contains(string(data), recorded.TokenKey), qt.IsTrue)
+
+	// Replay the session after the server has gone.
+	srv.Close()
+	interactions, err := record.Load(path)
+	c.Assert(err, qt.IsNil)
+	replayer := record.NewReplayer(interactions)
+	server.Client = &http.Client{Transport: replayer}
+	replayed := session(c, server)
+	c.Assert(replayed.TokenKey, qt.Equals, recorded.TokenKey)
+	c.Assert(replayed.TokenSecret, qt.Equals, record.Redacted)
+	c.Assert(replayer.Unused(), qt.HasLen, 0)
+
+	// Every interaction has been used.
+	_, err = server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, `Post "?http://.*/api/v2/tokens/oauth"?: no recorded interaction matches POST http://.*/api/v2/tokens/oauth`)
+}
+
+func TestReplayMatchesBody(t *testing.T) {
+	c := qt.New(t)
+
+	replayer := record.NewReplayer([]record.Interaction{{
+		Request: record.Request{
+			Method: "POST",
+			URL:    "https://login.example.com/api/v2/tokens/oauth",
+			Body:   `{"email":"foo@bar.com","password":"REDACTED","token_name":"other"}`,
+		},
+		Response: record.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       `{"token_name": "other"}`,
+		},
+	}})
+	server := usso.NewUbuntuSSOServer("https://login.example.com", "")
+	server.Client = &http.Client{Transport: replayer}
+	_, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, `.*no recorded interaction matches POST https://login.example.com/api/v2/tokens/oauth`)
+	c.Assert(replayer.Unused(), qt.HasLen, 1)
+	ssodata, err := server.GetToken(email, password, "other")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata.TokenName, qt.Equals, "other")
+	c.Assert(replayer.Unused(), qt.HasLen, 0)
+}
+
+// A replayed error page is reported in the same way as the original.
+func TestReplayNonJSONError(t *testing.T) {
+	c := qt.New(t)
+
+	replayer := record.NewReplayer([]record.Interaction{{
+		Request: record.Request{
+			Method: "GET",
+			URL:    "https://login.example.com/api/v2/tokens/oauth/abcs",
+		},
+		Response: record.Response{
+			StatusCode: http.StatusBadGateway,
+			Header:     http.Header{"Content-Type": {"text/html"}},
+			Body:       `<html>Bad Gateway</html>`,
+		},
+	}})
+	server := usso.NewUbuntuSSOServer("https://login.example.com", "")
+	server.Client = &http.Client{Transport: replayer}
+	_, err := server.GetTokenDetails(&usso.SSOData{
+		ConsumerKey:    "consumer",
+		ConsumerSecret: "secret",
+		TokenKey:       "abcs",
+		TokenSecret:    "secret",
+	})
+	c.Assert(err, qt.ErrorMatches, usso.CodeInvalidCredentials)
+	c.Assert(err.(*usso.Error).StatusCode, qt.Equals, http.StatusBadGateway)
+	c.Assert(replayer.Unused(), qt.HasLen, 0)
+}
+
+func TestScrubQueryAndForm(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	rec := &record.Recorder{}
+	client := &http.Client{Transport: rec}
+	resp, err := client.PostForm(srv.URL+"/+access-token?oauth_nonce=123&a=b&oauth_signature=xyz", map[string][]string{
+		"oauth_signature": {"consumer&secret"},
+		"oauth_token":     {"token"},
+	})
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	in := rec.Interactions()[0]
+	c.Assert(in.Request.URL, qt.Equals, srv.URL+"/+access-token?a=b")
+	c.Assert(in.Request.Body, qt.Equals, "oauth_token=token")
+}
+
+func TestScrubCredentials(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"discharge_macaroon": "discharge-secret"}`))
+	}))
+	defer srv.Close()
+	rec := &record.Recorder{}
+	body := ioutil.NopCloser(strings.NewReader(`{"macaroon": "root"}`))
+	req, err := http.NewRequest("POST", srv.URL+"/+id?openid.macaroon.discharge=openid-secret", body)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Macaroon macaroon-secret")
+	resp, err := rec.RoundTrip(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	// The caller's request is not modified.
+	c.Assert(req.Body, qt.Equals, body)
+
+	in := rec.Interactions()[0]
+	c.Assert(in.Request.URL, qt.Equals, srv.URL+"/+id?openid.macaroon.discharge="+record.Redacted)
+	c.Assert(in.Request.Header.Get("Authorization"), qt.Equals, "Macaroon "+record.Redacted)
+	c.Assert(in.Response.Body, qt.Equals, `{"discharge_macaroon":"`+record.Redacted+`"}`)
+}
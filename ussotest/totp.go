@@ -0,0 +1,48 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package ussotest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// totpStep holds the time for which each one-time password is valid.
+const totpStep = 30 * time.Second
+
+// TOTP returns the time-based one-time password for the given seed at
+// time t, as described in RFC 6238, using HMAC-SHA1 and six digits.
+// Tests can use it to generate the one-time password for a User with
+// an OTPSeed.
+func TOTP(seed []byte, t time.Time) string {
+	return hotp(seed, uint64(t.Unix()/int64(totpStep/time.Second)))
+}
+
+// hotp returns the HMAC-based one-time password for the given seed and
+// counter, as described in RFC 4226.
+func hotp(seed []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	h := hmac.New(sha1.New, seed)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// validOTP reports whether otp is a valid one-time password for the
+// seed at time t. The passwords for the steps either side of t are also
+// accepted, to allow for clock differences.
+func validOTP(seed []byte, otp string, t time.Time) bool {
+	for _, d := range []time.Duration{0, -totpStep, totpStep} {
+		if hmac.Equal([]byte(TOTP(seed, t.Add(d))), []byte(otp)) {
+			return true
+		}
+	}
+	return false
+}
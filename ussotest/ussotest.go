@@ -0,0 +1,572 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+// Package ussotest provides an in-process fake Ubuntu SSO server for use
+// in tests. The fake implements the token, token details, account,
+// registration and password reset endpoints of the Ubuntu SSO API and
+// verifies the OAuth signatures of the requests made to it.
+//
+// A Server listens on a local address of its own. A Handler implements
+// the same fake as an http.Handler, for serving alongside other
+// handlers.
+package ussotest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/usso"
+)
+
+// User holds the details of an account known to the fake server.
+type User struct {
+	// Email holds the email address used to log in.
+	Email string
+
+	// Password holds the account's password.
+	Password string
+
+	// DisplayName holds the user's name as displayed to others.
+	DisplayName string
+
+	// Username holds the account's user name, if it has one.
+	Username string
+
+	// OpenID holds the account's OpenID identifier, which is also
+	// used as the consumer key of its tokens. If it is blank then one
+	// is generated.
+	OpenID string
+
+	// ConsumerSecret holds the consumer secret of the account's
+	// tokens. If it is blank then one is generated.
+	ConsumerSecret string
+
+	// OTPSeed holds the secret used to generate the account's
+	// time-based one-time passwords, see TOTP. If it is not empty then
+	// a one-time password is required to create tokens.
+	OTPSeed []byte
+
+	// Suspended records that the account has been suspended, so no
+	// tokens can be created for it.
+	Suspended bool
+}
+
+// ScriptedError describes an error response returned instead of the
+// normal response to a request.
+type ScriptedError struct {
+	// Method holds the HTTP method of the requests the error applies
+	// to. If it is blank the error applies to requests with any method.
+	Method string
+
+	// Path holds the path prefix of the requests the error applies
+	// to. If it is blank the error applies to requests for any path.
+	Path string
+
+	// Status holds the HTTP status code of the response.
+	Status int
+
+	// Code, Message and Extra hold the contents of the JSON error in
+	// the response.
+	Code    string
+	Message string
+	Extra   map[string]interface{}
+}
+
+// Handler implements a fake Ubuntu SSO server as an http.Handler, so
+// that it can be served alongside other handlers. The OAuth signatures
+// of requests are verified against the host the request was sent to. A
+// Handler is safe for concurrent use.
+type Handler struct {
+	mu              sync.Mutex
+	users           map[string]*account
+	tokens          map[string]*token
+	faults          []*Fault
+	captchaID       string
+	captchaSolution string
+	resets          []string
+}
+
+// account holds a user known to the server.
+type account struct {
+	User
+}
+
+// token holds a token issued by the server.
+type token struct {
+	usso.TokenDetails
+	secret string
+	email  string
+}
+
+// NewHandler returns a new handler with no users.
+func NewHandler() *Handler {
+	return &Handler{
+		users:  make(map[string]*account),
+		tokens: make(map[string]*token),
+	}
+}
+
+// Server is a fake Ubuntu SSO server listening on a local address.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts and returns a new fake server with no users. The
+// caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{
+		Server:  httptest.NewServer(h),
+		Handler: h,
+	}
+}
+
+// UbuntuSSOServer returns an UbuntuSSOServer that sends requests to
+// the fake server.
+func (s *Server) UbuntuSSOServer() usso.UbuntuSSOServer {
+	return usso.NewUbuntuSSOServer(s.URL, "")
+}
+
+// AddUser adds a user to the server, replacing any user with the same
+// email address. It returns the user as added, with any generated
+// values filled in.
+func (h *Handler) AddUser(u User) User {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.addUser(u).User
+}
+
+// addUser adds a user to the server and returns its account. It must be
+// called with h.mu held.
+func (h *Handler) addUser(u User) *account {
+	if u.OpenID == "" {
+		u.OpenID = randomString(7)
+	}
+	if u.ConsumerSecret == "" {
+		u.ConsumerSecret = randomString(30)
+	}
+	a := &account{
+		User: u,
+	}
+	h.users[u.Email] = a
+	return a
+}
+
+// SetCaptcha makes the server require the given captcha to be solved
+// when an account is registered. If id is blank no captcha is required.
+func (h *Handler) SetCaptcha(id, solution string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.captchaID = id
+	h.captchaSolution = solution
+}
+
+// PasswordResets returns the email addresses for which a password reset
+// has been requested, in the order they were requested.
+func (h *Handler) PasswordResets() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.resets...)
+}
+
+// SetSuspended sets whether the account with the given email address is
+// suspended.
+func (h *Handler) SetSuspended(email string, suspended bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if a, ok := h.users[email]; ok {
+		a.Suspended = suspended
+	}
+}
+
+// AddToken creates a token with the given name for the user with the
+// given email address without going through the API. It returns nil if
+// there is no such user.
+func (h *Handler) AddToken(email, name string) *usso.SSOData {
+	return h.AddTokenCredentials(email, name, "", "")
+}
+
+// AddTokenCredentials is like AddToken but creates the token with the
+// given key and secret, so that clients can be configured with known
+// credentials. If key or secret is blank then one is generated.
+func (h *Handler) AddTokenCredentials(email, name, key, secret string) *usso.SSOData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, ok := h.users[email]
+	if !ok {
+		return nil
+	}
+	return h.newToken(a, name, key, secret)
+}
+
+// newToken creates a new token for a. If key or secret is blank then
+// one is generated. It must be called with h.mu held.
+func (h *Handler) newToken(a *account, name, key, secret string) *usso.SSOData {
+	if key == "" {
+		key = randomString(50)
+	}
+	if secret == "" {
+		secret = randomString(50)
+	}
+	t := &token{
+		TokenDetails: usso.TokenDetails{
+			TokenName:   name,
+			TokenKey:    key,
+			ConsumerKey: a.OpenID,
+			Created:     time.Now().UTC(),
+		},
+		secret: secret,
+		email:  a.Email,
+	}
+	t.Updated = t.Created
+	t.Href = "/api/v2/tokens/oauth/" + t.TokenKey
+	h.tokens[t.TokenKey] = t
+	return &usso.SSOData{
+		ConsumerKey:    a.OpenID,
+		ConsumerSecret: a.ConsumerSecret,
+		Realm:          "API",
+		TokenKey:       t.TokenKey,
+		TokenSecret:    t.secret,
+		TokenName:      name,
+	}
+}
+
+// Tokens returns the details of the tokens issued to the user with the
+// given email address.
+func (h *Handler) Tokens(email string) []usso.TokenDetails {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.accountTokens(email)
+}
+
+// accountTokens returns the tokens of the given user, oldest first. It
+// must be called with h.mu held.
+func (h *Handler) accountTokens(email string) []usso.TokenDetails {
+	var tokens []usso.TokenDetails
+	for _, t := range h.tokens {
+		if t.email == email {
+			tokens = append(tokens, t.TokenDetails)
+		}
+	}
+	sortTokens(tokens)
+	return tokens
+}
+
+// sortTokens sorts tokens by creation time, oldest first.
+func sortTokens(tokens []usso.TokenDetails) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].TokenKey < tokens[j].TokenKey
+	})
+}
+
+// ScriptError arranges for the next request matching e to receive the
+// error described by e instead of its normal response. Scripted errors
+// are used once each, in the order they were added.
+func (h *Handler) ScriptError(e ScriptedError) {
+	body, err := json.Marshal(usso.Error{
+		Code:    e.Code,
+		Message: e.Message,
+		Extra:   e.Extra,
+	})
+	if err != nil {
+		panic(err)
+	}
+	h.AddFault(Fault{
+		Method: e.Method,
+		Path:   e.Path,
+		Status: e.Status,
+		Body:   string(body),
+	})
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f, ok := h.fault(req); ok {
+		f.serve(w, req, h.serve)
+		return
+	}
+	h.serve(w, req)
+}
+
+// serve serves req without any faults.
+func (h *Handler) serve(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case path == "/api/v2/tokens/oauth" && req.Method == "POST":
+		h.serveCreateToken(w, req)
+	case path == "/api/v2/tokens/password" && req.Method == "POST":
+		h.servePasswordReset(w, req)
+	case path == "/api/v2/accounts" && req.Method == "POST":
+		h.serveRegister(w, req)
+	case strings.HasPrefix(path, "/api/v2/tokens/oauth/") && req.Method == "GET":
+		h.serveTokenDetails(w, req, strings.TrimPrefix(path, "/api/v2/tokens/oauth/"))
+	case strings.HasPrefix(path, "/api/v2/tokens/oauth/") && req.Method == "DELETE":
+		h.serveRevokeToken(w, req, strings.TrimPrefix(path, "/api/v2/tokens/oauth/"))
+	case strings.HasPrefix(path, "/api/v2/accounts/") && req.Method == "GET":
+		h.serveAccount(w, req, strings.TrimPrefix(path, "/api/v2/accounts/"))
+	default:
+		writeError(w, http.StatusNotFound, usso.CodeResourceNotFound, "Not found", nil)
+	}
+}
+
+// serveCreateToken serves a request to create a new token.
+func (h *Handler) serveCreateToken(w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+		TokenName string `json:"token_name"`
+		OTP       string `json:"otp"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, usso.CodeInvalidData, "Invalid request data", nil)
+		return
+	}
+	if data.TokenName == "" {
+		writeError(w, http.StatusBadRequest, usso.CodeInvalidData, "Invalid request data", map[string]interface{}{
+			"token_name": []string{"This field is required."},
+		})
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, ok := h.users[data.Email]
+	switch {
+	case !ok || a.Password != data.Password:
+		writeError(w, http.StatusUnauthorized, usso.CodeInvalidCredentials, "Provided email/password is not correct.", nil)
+	case a.Suspended:
+		writeError(w, http.StatusForbidden, usso.CodeAccountSuspended, "Your account has been suspended. Please contact login support to re-enable it", nil)
+	case len(a.OTPSeed) > 0 && data.OTP == "":
+		writeError(w, http.StatusUnauthorized, usso.CodeTwoFactorRequired, "2-factor authentication required.", nil)
+	case len(a.OTPSeed) > 0 && !validOTP(a.OTPSeed, data.OTP, time.Now()):
+		writeError(w, http.StatusForbidden, usso.CodeTwoFactorFailure, "The provided 2-factor key is not recognised.", nil)
+	default:
+		ssodata := h.newToken(a, data.TokenName, "", "")
+		t := h.tokens[ssodata.TokenKey]
+		writeJSON(w, http.StatusCreated, tokenResponse{
+			TokenDetails:   t.TokenDetails,
+			ConsumerSecret: ssodata.ConsumerSecret,
+			TokenSecret:    ssodata.TokenSecret,
+		})
+	}
+}
+
+// tokenResponse holds the response to a request to create a token.
+type tokenResponse struct {
+	usso.TokenDetails
+	ConsumerSecret string
+	TokenSecret    string
+}
+
+// MarshalJSON implements json.Marshaler. It is needed because
+// usso.TokenDetails implements json.Marshaler, which would otherwise
+// hide the secrets.
+func (r tokenResponse) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(r.TokenDetails)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["consumer_secret"] = r.ConsumerSecret
+	fields["token_secret"] = r.TokenSecret
+	return json.Marshal(fields)
+}
+
+// servePasswordReset serves a request to send a password reset email.
+func (h *Handler) servePasswordReset(w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, usso.CodeInvalidData, "Invalid request data", nil)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, ok := h.users[data.Email]
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, usso.CodeResourceNotFound, fmt.Sprintf("No account associated with %s", data.Email), nil)
+	case a.Suspended:
+		writeError(w, http.StatusForbidden, usso.CodeCanNotResetPassword, "Can not reset password. Please contact login support", nil)
+	default:
+		h.resets = append(h.resets, data.Email)
+		writeJSON(w, http.StatusCreated, map[string]string{"email": data.Email})
+	}
+}
+
+// serveRegister serves a request to register a new account.
+func (h *Handler) serveRegister(w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		DisplayName     string `json:"displayname"`
+		CaptchaID       string `json:"captcha_id"`
+		CaptchaSolution string `json:"captcha_solution"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, usso.CodeInvalidData, "Invalid request data", nil)
+		return
+	}
+	fieldErrors := make(map[string]interface{})
+	if !strings.Contains(data.Email, "@") {
+		fieldErrors["email"] = []string{"Enter a valid email address."}
+	}
+	if len(data.Password) < 8 {
+		fieldErrors["password"] = []string{"Password must be at least 8 characters long."}
+	}
+	if len(fieldErrors) > 0 {
+		writeError(w, http.StatusBadRequest, usso.CodeInvalidData, "Invalid request data", fieldErrors)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.captchaID != "" && data.CaptchaID == "":
+		writeError(w, http.StatusUnauthorized, usso.CodeCaptchaRequired, "A captcha challenge is required to complete the request.", nil)
+	case h.captchaID != "" && (data.CaptchaID != h.captchaID || data.CaptchaSolution != h.captchaSolution):
+		writeError(w, http.StatusForbidden, usso.CodeCaptchaFailure, "Failed response to captcha challenge.", nil)
+	case h.users[data.Email] != nil:
+		writeError(w, http.StatusConflict, usso.CodeAlreadyRegistered, "The email address is already registered", nil)
+	default:
+		a := h.addUser(User{
+			Email:       data.Email,
+			Password:    data.Password,
+			DisplayName: data.DisplayName,
+		})
+		writeJSON(w, http.StatusCreated, usso.Account{
+			OpenID:      a.OpenID,
+			Href:        "/api/v2/accounts/" + a.OpenID,
+			Email:       a.Email,
+			DisplayName: a.DisplayName,
+			Status:      accountStatus(a),
+		})
+	}
+}
+
+// serveTokenDetails serves a request for the details of a token.
+func (h *Handler) serveTokenDetails(w http.ResponseWriter, req *http.Request, key string) {
+	a, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tokens[key]
+	if !ok || t.email != a.Email {
+		writeError(w, http.StatusNotFound, usso.CodeResourceNotFound, "Token not found", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.TokenDetails)
+}
+
+// serveRevokeToken serves a request to revoke a token.
+func (h *Handler) serveRevokeToken(w http.ResponseWriter, req *http.Request, key string) {
+	a, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tokens[key]
+	if !ok || t.email != a.Email {
+		writeError(w, http.StatusNotFound, usso.CodeResourceNotFound, "Token not found", nil)
+		return
+	}
+	delete(h.tokens, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveAccount serves a request for the details of an account.
+func (h *Handler) serveAccount(w http.ResponseWriter, req *http.Request, openid string) {
+	a, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+	if a.OpenID != openid {
+		writeError(w, http.StatusNotFound, usso.CodeResourceNotFound, "Account not found", nil)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeJSON(w, http.StatusOK, usso.Account{
+		OpenID:      a.OpenID,
+		Href:        "/api/v2/accounts/" + a.OpenID,
+		Email:       a.Email,
+		DisplayName: a.DisplayName,
+		Username:    a.Username,
+		Status:      accountStatus(a),
+		Verified:    true,
+		Tokens:      h.accountTokens(a.Email),
+	})
+}
+
+// accountStatus returns the status reported for the given account.
+func accountStatus(a *account) string {
+	if a.Suspended {
+		return "Suspended"
+	}
+	return "Active"
+}
+
+// authenticate checks the OAuth signature of req and returns the
+// account that owns the token used to sign it. If the signature is not
+// valid it writes an error response and returns false.
+func (h *Handler) authenticate(w http.ResponseWriter, req *http.Request) (*account, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, err := h.verify(req)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, usso.CodeInvalidCredentials, err.Error(), nil)
+		return nil, false
+	}
+	if a.Suspended {
+		writeError(w, http.StatusForbidden, usso.CodeAccountSuspended, "Your account has been suspended.", nil)
+		return nil, false
+	}
+	acct := *a
+	return &acct, true
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response in the format used by Ubuntu
+// SSO.
+func writeError(w http.ResponseWriter, status int, code, message string, extra map[string]interface{}) {
+	writeJSON(w, status, usso.Error{
+		Code:    code,
+		Message: message,
+		Extra:   extra,
+	})
+}
+
+// randomString returns a random string of n letters.
+func randomString(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b)
+}
@@ -0,0 +1,383 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package ussotest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/usso"
+	"github.com/juju/usso/ussotest"
+)
+
+const (
+	email    = "foo@bar.com"
+	password = "foobarpwd"
+)
+
+func TestGetToken(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{
+		Email:       email,
+		Password:    password,
+		DisplayName: "Foo Bar",
+		OpenID:      "abcdefg",
+	})
+	server := srv.UbuntuSSOServer()
+	ssodata, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata.ConsumerKey, qt.Equals, "abcdefg")
+	c.Assert(ssodata.TokenName, qt.Equals, "my-token")
+	c.Assert(ssodata.Realm, qt.Equals, "API")
+	c.Assert(ssodata.ConsumerSecret, qt.Not(qt.Equals), "")
+	c.Assert(ssodata.TokenSecret, qt.Not(qt.Equals), "")
+
+	valid, err := server.IsTokenValid(ssodata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(valid, qt.IsTrue)
+
+	accounts, err := server.GetAccounts(ssodata)
+	c.Assert(err, qt.IsNil)
+	var account usso.Account
+	err = json.Unmarshal([]byte(accounts), &account)
+	c.Assert(err, qt.IsNil)
+	c.Assert(account.Email, qt.Equals, email)
+	c.Assert(account.DisplayName, qt.Equals, "Foo Bar")
+	c.Assert(account.Tokens, qt.HasLen, 1)
+	c.Assert(account.Tokens[0].TokenKey, qt.Equals, ssodata.TokenKey)
+}
+
+var getTokenErrorTests = []struct {
+	about       string
+	user        ussotest.User
+	password    string
+	otp         func(seed []byte) string
+	expectCode  string
+	expectError string
+}{{
+	about:       "wrong password",
+	user:        ussotest.User{Email: email, Password: password},
+	password:    "wrong",
+	expectCode:  usso.CodeInvalidCredentials,
+	expectError: "Provided email/password is not correct.",
+}, {
+	about:       "suspended",
+	user:        ussotest.User{Email: email, Password: password, Suspended: true},
+	password:    password,
+	expectCode:  usso.CodeAccountSuspended,
+	expectError: "Your account has been suspended.*",
+}, {
+	about:       "otp required",
+	user:        ussotest.User{Email: email, Password: password, OTPSeed: []byte("seed")},
+	password:    password,
+	expectCode:  usso.CodeTwoFactorRequired,
+	expectError: "2-factor authentication required.",
+}, {
+	about:    "wrong otp",
+	user:     ussotest.User{Email: email, Password: password, OTPSeed: []byte("seed")},
+	password: password,
+	otp: func(seed []byte) string {
+		return ussotest.TOTP(seed, time.Now().Add(-time.Hour))
+	},
+	expectCode:  usso.CodeTwoFactorFailure,
+	expectError: "The provided 2-factor key is not recognised.",
+}}
+
+func TestGetTokenErrors(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range getTokenErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			srv := ussotest.NewServer()
+			defer srv.Close()
+			srv.AddUser(test.user)
+			otp := ""
+			if test.otp != nil {
+				otp = test.otp(test.user.OTPSeed)
+			}
+			_, err := srv.UbuntuSSOServer().GetTokenWithOTP(email, test.password, otp, "my-token")
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(err.(*usso.Error).Code, qt.Equals, test.expectCode)
+		})
+	}
+}
+
+func TestGetTokenWithOTP(t *testing.T) {
+	c := qt.New(t)
+
+	seed := []byte("12345678901234567890")
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password, OTPSeed: seed})
+	ssodata, err := srv.UbuntuSSOServer().GetTokenWithOTP(email, password, ussotest.TOTP(seed, time.Now()), "my-token")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata.TokenName, qt.Equals, "my-token")
+}
+
+// The test vectors from RFC 6238 appendix B, truncated to six digits.
+var totpTests = []struct {
+	time   int64
+	expect string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTP(t *testing.T) {
+	c := qt.New(t)
+
+	seed := []byte("12345678901234567890")
+	for _, test := range totpTests {
+		c.Check(ussotest.TOTP(seed, time.Unix(test.time, 0)), qt.Equals, test.expect, qt.Commentf("%d", test.time))
+	}
+}
+
+func TestSignatureVerification(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	server := srv.UbuntuSSOServer()
+	ssodata := srv.AddToken(email, "my-token")
+	c.Assert(ssodata, qt.Not(qt.IsNil))
+
+	// Both legacy and strict signatures are accepted, with the OAuth
+	// parameters sent in the Authorization header or the query string.
+	for _, strict := range []bool{false, true} {
+		for _, transmission := range []usso.ParameterTransmission{usso.AuthorizationHeader, usso.QueryString} {
+			req, err := http.NewRequest("GET", srv.URL+"/api/v2/tokens/oauth/"+ssodata.TokenKey+"?a=b", nil)
+			c.Assert(err, qt.IsNil)
+			err = ssodata.SignRequest(&usso.RequestParameters{
+				HTTPMethod:      "GET",
+				BaseURL:         req.URL.String(),
+				Params:          req.URL.Query(),
+				SignatureMethod: usso.HMACSHA1{},
+				Strict:          strict,
+				Transmission:    transmission,
+			}, req)
+			c.Assert(err, qt.IsNil)
+			resp, err := http.DefaultClient.Do(req)
+			c.Assert(err, qt.IsNil)
+			resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK, qt.Commentf("strict %v, transmission %v", strict, transmission))
+		}
+	}
+
+	// The OAuth parameters and any other parameters in a form-encoded
+	// body are verified too.
+	body := url.Values{"a": {"b"}}
+	req, err := http.NewRequest("DELETE", srv.URL+"/api/v2/tokens/oauth/"+ssodata.TokenKey, strings.NewReader(body.Encode()))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rp := &usso.RequestParameters{
+		HTTPMethod:      "DELETE",
+		BaseURL:         req.URL.String(),
+		Params:          url.Values{"a": {"c"}},
+		SignatureMethod: usso.HMACSHA1{},
+		Transmission:    usso.FormBody,
+	}
+	err = ssodata.SignRequest(rp, req)
+	c.Assert(err, qt.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	req, err = http.NewRequest("DELETE", srv.URL+"/api/v2/tokens/oauth/"+ssodata.TokenKey, strings.NewReader(body.Encode()))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rp.Params = body
+	rp.Nonce, rp.Timestamp = "", ""
+	err = ssodata.SignRequest(rp, req)
+	c.Assert(err, qt.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNoContent)
+	c.Assert(srv.Tokens(email), qt.HasLen, 0)
+
+	bad := *srv.AddToken(email, "my-token")
+	bad.TokenSecret = "wrong"
+	_, err = server.GetTokenDetailsContext(context.Background(), &bad)
+	c.Assert(err, qt.ErrorMatches, usso.CodeInvalidCredentials)
+	c.Assert(err.(*usso.Error).StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func TestRevokeTokens(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	server := srv.UbuntuSSOServer()
+	ssodata := srv.AddToken(email, "current")
+	srv.AddToken(email, "bot-1")
+	srv.AddToken(email, "bot-2")
+	revoked, err := server.RevokeTokens(context.Background(), ssodata, usso.TokenNameHasPrefix("bot-"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(revoked, qt.HasLen, 2)
+	tokens := srv.Tokens(email)
+	c.Assert(tokens, qt.HasLen, 1)
+	c.Assert(tokens[0].TokenName, qt.Equals, "current")
+}
+
+func TestScriptError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.ScriptError(ussotest.ScriptedError{
+		Method:  "POST",
+		Path:    "/api/v2/tokens/oauth",
+		Status:  http.StatusTooManyRequests,
+		Code:    usso.CodeTooManyRequests,
+		Message: "Too many requests",
+	})
+	server := srv.UbuntuSSOServer()
+	_, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.ErrorMatches, "Too many requests")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeTooManyRequests)
+
+	// The error is only returned once.
+	_, err = server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestRegisterAccount(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.SetCaptcha("captcha", "solution")
+	server := srv.UbuntuSSOServer()
+	account, err := server.RegisterAccount(context.Background(), email, password, "Foo Bar", "captcha", "solution")
+	c.Assert(err, qt.IsNil)
+	c.Assert(account.OpenID, qt.Not(qt.Equals), "")
+	c.Assert(account, qt.DeepEquals, &usso.Account{
+		OpenID:      account.OpenID,
+		Href:        "/api/v2/accounts/" + account.OpenID,
+		Email:       email,
+		DisplayName: "Foo Bar",
+		Status:      "Active",
+	})
+
+	// The new account can be used to create tokens.
+	ssodata, err := server.GetToken(email, password, "my-token")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ssodata.ConsumerKey, qt.Equals, account.OpenID)
+}
+
+var registerAccountErrorTests = []struct {
+	about             string
+	email             string
+	password          string
+	captchaID         string
+	captchaSolution   string
+	expectError       string
+	expectCode        string
+	expectFieldErrors map[string][]string
+}{{
+	about:           "already registered",
+	email:           "taken@example.com",
+	password:        password,
+	captchaID:       "captcha",
+	captchaSolution: "solution",
+	expectError:     "The email address is already registered",
+	expectCode:      usso.CodeAlreadyRegistered,
+}, {
+	about:           "invalid email",
+	email:           "foo",
+	password:        password,
+	captchaID:       "captcha",
+	captchaSolution: "solution",
+	expectError:     `Invalid request data \(email: \[Enter a valid email address.\]\)`,
+	expectCode:      usso.CodeInvalidData,
+	expectFieldErrors: map[string][]string{
+		"email": {"Enter a valid email address."},
+	},
+}, {
+	about:           "weak password",
+	email:           email,
+	password:        "weak",
+	captchaID:       "captcha",
+	captchaSolution: "solution",
+	expectError:     `Invalid request data \(password: \[Password must be at least 8 characters long.\]\)`,
+	expectCode:      usso.CodeInvalidData,
+	expectFieldErrors: map[string][]string{
+		"password": {"Password must be at least 8 characters long."},
+	},
+}, {
+	about:       "captcha required",
+	email:       email,
+	password:    password,
+	expectError: "A captcha challenge is required to complete the request.",
+	expectCode:  usso.CodeCaptchaRequired,
+}, {
+	about:           "captcha failure",
+	email:           email,
+	password:        password,
+	captchaID:       "captcha",
+	captchaSolution: "wrong",
+	expectError:     "Failed response to captcha challenge.",
+	expectCode:      usso.CodeCaptchaFailure,
+}}
+
+func TestRegisterAccountErrors(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: "taken@example.com", Password: password})
+	srv.SetCaptcha("captcha", "solution")
+	server := srv.UbuntuSSOServer()
+	for _, test := range registerAccountErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			account, err := server.RegisterAccount(context.Background(), test.email, test.password, "Foo Bar", test.captchaID, test.captchaSolution)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(account, qt.IsNil)
+			ssoError, ok := err.(*usso.Error)
+			c.Assert(ok, qt.Equals, true)
+			c.Assert(ssoError.Code, qt.Equals, test.expectCode)
+			c.Assert(ssoError.FieldErrors(), qt.DeepEquals, test.expectFieldErrors)
+		})
+	}
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	c := qt.New(t)
+
+	srv := ussotest.NewServer()
+	defer srv.Close()
+	srv.AddUser(ussotest.User{Email: email, Password: password})
+	srv.AddUser(ussotest.User{Email: "suspended@example.com", Password: password, Suspended: true})
+	server := srv.UbuntuSSOServer()
+	err := server.RequestPasswordReset(context.Background(), email)
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.PasswordResets(), qt.DeepEquals, []string{email})
+
+	err = server.RequestPasswordReset(context.Background(), "unknown@example.com")
+	c.Assert(err, qt.ErrorMatches, "No account associated with unknown@example.com")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeResourceNotFound)
+
+	err = server.RequestPasswordReset(context.Background(), "suspended@example.com")
+	c.Assert(err, qt.ErrorMatches, "Can not reset password. Please contact login support")
+	c.Assert(err.(*usso.Error).Code, qt.Equals, usso.CodeCanNotResetPassword)
+	c.Assert(srv.PasswordResets(), qt.DeepEquals, []string{email})
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenStatus holds the outcome of validating a token.
+type TokenStatus int
+
+const (
+	// TokenValid is reported when the server accepted the token.
+	TokenValid TokenStatus = iota
+
+	// TokenInvalid is reported when the server rejected the token,
+	// for example because it has been revoked.
+	TokenInvalid
+
+	// TokenError is reported when the validity of the token could not
+	// be determined, for example because the server was unavailable.
+	TokenError
+)
+
+var tokenStatusNames = []string{
+	TokenValid:   "valid",
+	TokenInvalid: "invalid",
+	TokenError:   "error",
+}
+
+// String implements fmt.Stringer.
+func (s TokenStatus) String() string {
+	if s < 0 || int(s) >= len(tokenStatusNames) {
+		return "unknown"
+	}
+	return tokenStatusNames[s]
+}
+
+// TokenResult holds the result of validating a single token.
+type TokenResult struct {
+	// Index holds the index of the token in the slice passed to
+	// Validate.
+	Index int
+
+	// SSOData holds the credentials that were validated.
+	SSOData *SSOData
+
+	// Status holds the outcome of the validation.
+	Status TokenStatus
+
+	// Err holds the error returned by the server, if any. It is set
+	// for invalid tokens as well as errors.
+	Err error
+}
+
+// BatchValidator checks the validity of many tokens concurrently.
+type BatchValidator struct {
+	// Server holds the server used to check the tokens. Its Client and
+	// RetryPolicy are used for every request.
+	Server UbuntuSSOServer
+
+	// Workers holds the maximum number of tokens checked at the same
+	// time. If it is less than 1 then 4 workers are used.
+	Workers int
+
+	// Interval holds the minimum time between the start of requests
+	// to the server, across all workers. If it is zero requests are
+	// not rate limited.
+	Interval time.Duration
+}
+
+// Validate checks the validity of the given tokens and sends a result
+// for each of them on the returned channel, in the order the checks
+// complete. The channel is closed when all the tokens have been
+// checked. If the context is cancelled no more tokens are checked and
+// the channel is closed once the checks in progress have finished, so
+// not every token will have a result. The caller must either read from
+// the channel until it is closed or cancel the context.
+func (v BatchValidator) Validate(ctx context.Context, tokens []*SSOData) <-chan TokenResult {
+	workers := v.Workers
+	if workers < 1 {
+		workers = 4
+	}
+	var tick <-chan time.Time
+	var stop func()
+	if v.Interval > 0 {
+		ticker := time.NewTicker(v.Interval)
+		tick, stop = ticker.C, ticker.Stop
+	}
+	jobs := make(chan int)
+	results := make(chan TokenResult)
+	go func() {
+		defer close(jobs)
+		for i := range tokens {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for n := 0; n < workers; n++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := v.validate(ctx, i, tokens[i])
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		if stop != nil {
+			stop()
+		}
+		close(results)
+	}()
+	return results
+}
+
+// validate checks a single token.
+func (v BatchValidator) validate(ctx context.Context, i int, ssodata *SSOData) TokenResult {
+	r := TokenResult{
+		Index:   i,
+		SSOData: ssodata,
+	}
+	var valid bool
+	valid, r.Err = v.Server.IsTokenValidContext(ctx, ssodata)
+	r.Status = tokenStatus(valid, r.Err)
+	return r
+}
+
+// tokenStatus classifies the result of IsTokenValid.
+func tokenStatus(valid bool, err error) TokenStatus {
+	switch {
+	case valid:
+		return TokenValid
+	case err == nil || IsInvalidToken(err):
+		return TokenInvalid
+	default:
+		return TokenError
+	}
+}
+
+// IsInvalidToken reports whether err, returned from a request signed
+// with a token, shows that the server rejected the credentials, as
+// opposed to failing to check them.
+func IsInvalidToken(err error) bool {
+	ssoError, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch {
+	case ssoError.StatusCode == http.StatusUnauthorized, ssoError.StatusCode == http.StatusForbidden:
+		return true
+	case ssoError.StatusCode >= 500, ssoError.StatusCode == http.StatusTooManyRequests:
+		// GetTokenDetails reports responses without a JSON
+		// error as invalid credentials, even if the server
+		// failed.
+		return false
+	}
+	return ssoError.Code == CodeInvalidCredentials
+}
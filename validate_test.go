@@ -0,0 +1,190 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENSE file for details.
+
+package usso
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// validationServer is a fake token details endpoint. Tokens with keys
+// starting "good" are valid, those starting "bad" are invalid and any
+// others cause a server error. Each request is delayed by delay. The
+// maximum number of requests handled at the same time is recorded in
+// maxConcurrent.
+type validationServer struct {
+	delay time.Duration
+
+	mu            sync.Mutex
+	concurrent    int
+	maxConcurrent int
+}
+
+func (s *validationServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.concurrent++
+	if s.concurrent > s.maxConcurrent {
+		s.maxConcurrent = s.concurrent
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.concurrent--
+		s.mu.Unlock()
+	}()
+	time.Sleep(s.delay)
+	key := strings.TrimPrefix(req.URL.Path, "/api/v2/tokens/oauth/")
+	switch {
+	case strings.HasPrefix(key, "good"):
+		json.NewEncoder(w).Encode(map[string]string{
+			"token_key":  key,
+			"token_name": tokenName,
+		})
+	case strings.HasPrefix(key, "bad"):
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Error{
+			Code:    CodeInvalidCredentials,
+			Message: "Invalid token",
+		})
+	default:
+		http.Error(w, "<html>Service Unavailable</html>", http.StatusServiceUnavailable)
+	}
+}
+
+func tokensWithKeys(keys ...string) []*SSOData {
+	tokens := make([]*SSOData, len(keys))
+	for i, key := range keys {
+		tokens[i] = &SSOData{
+			ConsumerKey:    consumerKey,
+			ConsumerSecret: consumerSecret,
+			TokenKey:       key,
+			TokenSecret:    tokenSecret,
+		}
+	}
+	return tokens
+}
+
+func TestBatchValidatorValidate(t *testing.T) {
+	c := qt.New(t)
+
+	h := &validationServer{delay: 10 * time.Millisecond}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	v := BatchValidator{
+		Server:  UbuntuSSOServer{baseUrl: srv.URL},
+		Workers: 3,
+	}
+	tokens := tokensWithKeys("good1", "bad1", "broken", "good2", "bad2", "good3", "good4", "good5")
+	var results []TokenResult
+	for r := range v.Validate(context.Background(), tokens) {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Index < results[j].Index
+	})
+	c.Assert(results, qt.HasLen, len(tokens))
+	var statuses []TokenStatus
+	for i, r := range results {
+		c.Assert(r.Index, qt.Equals, i)
+		c.Assert(r.SSOData, qt.Equals, tokens[i])
+		statuses = append(statuses, r.Status)
+	}
+	c.Assert(statuses, qt.DeepEquals, []TokenStatus{
+		TokenValid,
+		TokenInvalid,
+		TokenError,
+		TokenValid,
+		TokenInvalid,
+		TokenValid,
+		TokenValid,
+		TokenValid,
+	})
+	c.Assert(results[0].Err, qt.IsNil)
+	c.Assert(results[1].Err, qt.ErrorMatches, "INVALID_CREDENTIALS")
+	c.Assert(results[2].Err, qt.Not(qt.IsNil))
+	c.Assert(h.maxConcurrent > 1, qt.IsTrue)
+	c.Assert(h.maxConcurrent <= 3, qt.IsTrue)
+}
+
+func TestBatchValidatorInterval(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	v := BatchValidator{
+		Server:   UbuntuSSOServer{baseUrl: srv.URL},
+		Workers:  4,
+		Interval: 20 * time.Millisecond,
+	}
+	start := time.Now()
+	n := 0
+	for r := range v.Validate(context.Background(), tokensWithKeys("good1", "good2", "good3", "good4")) {
+		c.Assert(r.Status, qt.Equals, TokenValid)
+		n++
+	}
+	c.Assert(n, qt.Equals, 4)
+	c.Assert(time.Since(start) >= 60*time.Millisecond, qt.IsTrue)
+}
+
+func TestBatchValidatorCancel(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(&validationServer{})
+	defer srv.Close()
+	v := BatchValidator{
+		Server:   UbuntuSSOServer{baseUrl: srv.URL},
+		Workers:  1,
+		Interval: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := v.Validate(ctx, tokensWithKeys("good1", "good2", "good3"))
+	r := <-results
+	c.Assert(r.Status, qt.Equals, TokenValid)
+	cancel()
+	select {
+	case _, ok := <-results:
+		c.Assert(ok, qt.IsFalse)
+	case <-time.After(5 * time.Second):
+		c.Fatal("results not closed after cancel")
+	}
+}
+
+func TestTokenStatusString(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(TokenValid.String(), qt.Equals, "valid")
+	c.Assert(TokenInvalid.String(), qt.Equals, "invalid")
+	c.Assert(TokenError.String(), qt.Equals, "error")
+	c.Assert(TokenStatus(99).String(), qt.Equals, "unknown")
+}
+
+var isInvalidTokenTests = []struct {
+	err    error
+	expect bool
+}{
+	{&Error{StatusCode: http.StatusUnauthorized}, true},
+	{&Error{StatusCode: http.StatusForbidden, Code: "FORBIDDEN"}, true},
+	{&Error{StatusCode: http.StatusNotFound, Code: CodeInvalidCredentials}, true},
+	{&Error{StatusCode: http.StatusNotFound, Code: CodeResourceNotFound}, false},
+	{&Error{StatusCode: http.StatusBadGateway, Code: CodeInvalidCredentials}, false},
+	{&Error{StatusCode: http.StatusTooManyRequests, Code: CodeInvalidCredentials}, false},
+	{context.DeadlineExceeded, false},
+}
+
+func TestIsInvalidToken(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range isInvalidTokenTests {
+		c.Check(IsInvalidToken(test.err), qt.Equals, test.expect, qt.Commentf("%#v", test.err))
+	}
+}